@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+// adminMiddleware guards operator endpoints with the ADMIN_API_KEY sent in
+// the X-Admin-Key header. Without a configured key the endpoints are off.
+func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := os.Getenv("ADMIN_API_KEY")
+		if key == "" {
+			http.Error(w, "Admin API disabled", http.StatusForbidden)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Key")), []byte(key)) != 1 {
+			http.Error(w, "Invalid admin key", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func createClientHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name         string   `json:"client_name"`
+		Public       bool     `json:"public"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		http.Error(w, "client_name is required", http.StatusBadRequest)
+		return
+	}
+
+	var secret string
+	if !req.Public {
+		secret = generateToken()
+	}
+	client := &OAuthClient{
+		ID:           generateID(),
+		Name:         req.Name,
+		RedirectURIs: req.RedirectURIs,
+		Scopes:       req.Scopes,
+	}
+	if err := clientStore.Register(client, secret); err != nil {
+		http.Error(w, "Failed to create client", http.StatusInternalServerError)
+		return
+	}
+
+	auditLogger.Log("", "client_created", "client", r.RemoteAddr, map[string]interface{}{
+		"client_id": client.ID,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"client_id":     client.ID,
+		"client_name":   client.Name,
+		"client_secret": secret, // Only shown once
+		"public":        client.Public,
+		"redirect_uris": client.RedirectURIs,
+		"scopes":        client.Scopes,
+	})
+}
+
+func rotateClientSecretHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ClientID string `json:"client_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := clientStore.RotateSecret(req.ClientID)
+	if err != nil {
+		http.Error(w, "Confidential client not found", http.StatusNotFound)
+		return
+	}
+
+	auditLogger.Log("", "client_secret_rotated", "client", r.RemoteAddr, map[string]interface{}{
+		"client_id": req.ClientID,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{
+		"client_id":     req.ClientID,
+		"client_secret": secret,
+	})
+}
+
+func disableClientHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ClientID string `json:"client_id"`
+		Disabled *bool  `json:"disabled"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Disabling is the default; {"disabled": false} re-enables the client
+	disabled := req.Disabled == nil || *req.Disabled
+	if err := clientStore.SetDisabled(req.ClientID, disabled); err != nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	action := "client_disabled"
+	if !disabled {
+		action = "client_enabled"
+	}
+	auditLogger.Log("", action, "client", r.RemoteAddr, map[string]interface{}{
+		"client_id": req.ClientID,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"client_id": req.ClientID,
+		"disabled":  disabled,
+	})
+}
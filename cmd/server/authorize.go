@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const authorizationCodeTTL = 5 * time.Minute
+
+type AuthorizationCode struct {
+	Code          string
+	ClientID      string
+	UserID        string
+	RedirectURI   string
+	Scope         string
+	CodeChallenge string
+	Nonce         string
+	AuthTime      time.Time
+	AMR           []string
+	ExpiresAt     time.Time
+	// Used codes are kept until they expire; FamilyID is the refresh token
+	// family they were redeemed for, revoked if the code is replayed.
+	Used     bool
+	FamilyID string
+}
+
+var authCodes = &struct {
+	mu    sync.Mutex
+	codes map[string]*AuthorizationCode
+}{
+	codes: make(map[string]*AuthorizationCode),
+}
+
+// deleteExpiredAuthCodes drops codes that were never exchanged.
+func deleteExpiredAuthCodes(now time.Time) int {
+	authCodes.mu.Lock()
+	defer authCodes.mu.Unlock()
+
+	n := 0
+	for code, ac := range authCodes.codes {
+		if now.After(ac.ExpiresAt) {
+			delete(authCodes.codes, code)
+			n++
+		}
+	}
+	return n
+}
+
+// authorizeRequest holds the validated parameters of an /oauth/authorize call.
+type authorizeRequest struct {
+	ClientID      string
+	ClientName    string
+	RedirectURI   string
+	ResponseType  string
+	State         string
+	Scope         string
+	CodeChallenge string
+	Nonce         string
+	Error         string
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Sign in</title></head>
+<body>
+<h1>Sign in to {{.ClientName}}</h1>
+{{if .Error}}<p style="color:red">{{.Error}}</p>{{end}}
+<form method="POST" action="/oauth/authorize">
+<input type="hidden" name="client_id" value="{{.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="response_type" value="{{.ResponseType}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="scope" value="{{.Scope}}">
+<input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="S256">
+<input type="hidden" name="nonce" value="{{.Nonce}}">
+<p><label>Email <input type="email" name="email" required></label></p>
+<p><label>Password <input type="password" name="password" required></label></p>
+<p><label>Authentication code (if enabled) <input type="text" name="otp" autocomplete="one-time-code"></label></p>
+{{if .Scope}}<p>{{.ClientName}} is requesting: {{.Scope}}</p>{{end}}
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+// authorizeHandler implements the authorization code grant with PKCE. GET
+// shows the sign-in form; POST checks the credentials and redirects back to
+// the client with a code.
+func authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Until the client and redirect URI are known to be good, errors must
+	// not be redirected anywhere
+	client, exists := clientStore.Get(r.Form.Get("client_id"))
+	if !exists || client.Disabled {
+		http.Error(w, "Unknown client", http.StatusBadRequest)
+		return
+	}
+	redirectURI := r.Form.Get("redirect_uri")
+	if !client.AllowsRedirect(redirectURI) {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	req := &authorizeRequest{
+		ClientID:      client.ID,
+		ClientName:    client.Name,
+		RedirectURI:   redirectURI,
+		ResponseType:  r.Form.Get("response_type"),
+		State:         r.Form.Get("state"),
+		Scope:         r.Form.Get("scope"),
+		CodeChallenge: r.Form.Get("code_challenge"),
+		Nonce:         r.Form.Get("nonce"),
+	}
+
+	if req.ResponseType != "code" {
+		redirectAuthorizeError(w, r, req, "unsupported_response_type", "Only response_type=code is supported")
+		return
+	}
+	if req.CodeChallenge == "" || r.Form.Get("code_challenge_method") != "S256" {
+		redirectAuthorizeError(w, r, req, "invalid_request", "PKCE with code_challenge_method=S256 is required")
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = strings.Join(client.Scopes, " ")
+	}
+	if !scopeSubset(parseScope(req.Scope), client.Scopes) {
+		redirectAuthorizeError(w, r, req, "invalid_scope", "Requested scope is not allowed for this client")
+		return
+	}
+	if hasScope(req.Scope, "openid") && !oidcEnabled() {
+		redirectAuthorizeError(w, r, req, "invalid_scope", "OpenID Connect is not enabled on this server")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		renderLoginPage(w, req)
+		return
+	}
+
+	user, err := authenticateUser(r, r.PostForm.Get("email"), r.PostForm.Get("password"))
+	if err != nil {
+		req.Error = loginFormError(err)
+		renderLoginPage(w, req)
+		return
+	}
+
+	secondFactor, message := formSecondFactor(r, user.ID, r.PostForm.Get("otp"))
+	if message != "" {
+		req.Error = message
+		renderLoginPage(w, req)
+		return
+	}
+	amr := append([]string{"pwd"}, secondFactor...)
+
+	code := generateToken()
+	authCodes.mu.Lock()
+	authCodes.codes[code] = &AuthorizationCode{
+		Code:          code,
+		ClientID:      client.ID,
+		UserID:        user.ID,
+		RedirectURI:   redirectURI,
+		Scope:         req.Scope,
+		CodeChallenge: req.CodeChallenge,
+		Nonce:         req.Nonce,
+		AuthTime:      time.Now(),
+		AMR:           amr,
+		ExpiresAt:     time.Now().Add(authorizationCodeTTL),
+	}
+	authCodes.mu.Unlock()
+
+	params := url.Values{"code": {code}}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	redirectWithParams(w, r, redirectURI, params)
+}
+
+func renderLoginPage(w http.ResponseWriter, req *authorizeRequest) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	loginPage.Execute(w, req)
+}
+
+func redirectAuthorizeError(w http.ResponseWriter, r *http.Request, req *authorizeRequest, code, description string) {
+	params := url.Values{
+		"error":             {code},
+		"error_description": {description},
+	}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	redirectWithParams(w, r, req.RedirectURI, params)
+}
+
+func redirectWithParams(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// redeemAuthorizationCode consumes a code for client. familyID is recorded
+// against the code so a later replay can revoke what it was redeemed for.
+func redeemAuthorizationCode(r *http.Request, code, clientID, redirectURI, verifier, familyID string) (*AuthorizationCode, bool) {
+	authCodes.mu.Lock()
+	ac, exists := authCodes.codes[code]
+	if !exists || ac.ClientID != clientID || time.Now().After(ac.ExpiresAt) {
+		authCodes.mu.Unlock()
+		return nil, false
+	}
+	if ac.Used {
+		authCodes.mu.Unlock()
+		revoked := revokeFamily(ac.UserID, ac.FamilyID)
+		auditLogger.Log(ac.UserID, "authorization_code_reuse", "authorization_code", r.RemoteAddr, map[string]interface{}{
+			"client_id":        clientID,
+			"family_id":        ac.FamilyID,
+			"revoked_sessions": revoked,
+		})
+		return nil, false
+	}
+	ac.Used = true
+	ac.FamilyID = familyID
+	authCodes.mu.Unlock()
+
+	if ac.RedirectURI != redirectURI || !verifyCodeChallenge(verifier, ac.CodeChallenge) {
+		return nil, false
+	}
+	return ac, true
+}
+
+// verifyCodeChallenge checks an RFC 7636 S256 code verifier.
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAuthorizeRejectsDisabledClient(t *testing.T) {
+	client := &OAuthClient{
+		ID:           "authorize-disabled-client",
+		RedirectURIs: []string{"https://app.example.com/callback"},
+		Scopes:       []string{"read"},
+	}
+	if err := clientStore.Register(client, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientStore.SetDisabled(client.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	query := url.Values{
+		"client_id":             {client.ID},
+		"redirect_uri":          {"https://app.example.com/callback"},
+		"response_type":         {"code"},
+		"code_challenge":        {"challenge"},
+		"code_challenge_method": {"S256"},
+	}
+	w := httptest.NewRecorder()
+	authorizeHandler(w, httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+query.Encode(), nil))
+
+	// Answered in place, like an unknown client, not redirected
+	if w.Code != http.StatusBadRequest || w.Header().Get("Location") != "" {
+		t.Fatalf("disabled client got %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errClientExists   = errors.New("client already exists")
+	errClientNotFound = errors.New("client not found")
+)
+
+// OAuthClient is an application allowed to call the OAuth endpoints.
+// Public clients (browser and native apps) have no secret. Clients are
+// treated as immutable once stored; updates replace the whole entry.
+type OAuthClient struct {
+	ID           string
+	Name         string
+	SecretHash   string
+	Public       bool
+	Disabled     bool
+	RedirectURIs []string
+	Scopes       []string
+	// TokenExchange is nil for clients that may not use token exchange
+	TokenExchange *ExchangePolicy
+	CreatedAt     time.Time
+}
+
+// AllowsRedirect reports whether uri exactly matches a registered redirect URI.
+func (c *OAuthClient) AllowsRedirect(uri string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if uri == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientStore is the in-memory ClientRepository.
+type ClientStore struct {
+	mu      sync.RWMutex
+	clients map[string]*OAuthClient
+}
+
+var clientStore ClientRepository = &ClientStore{
+	clients: make(map[string]*OAuthClient),
+}
+
+// prepareClient readies a client for storage: it is public if registered
+// without a secret, and otherwise only a hash of the secret is kept.
+func prepareClient(client *OAuthClient, secret string) error {
+	client.Public = secret == ""
+	client.SecretHash = ""
+	if !client.Public {
+		hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		client.SecretHash = string(hash)
+	}
+	client.CreatedAt = time.Now()
+	return nil
+}
+
+// newClientSecret generates a client secret and its hash.
+func newClientSecret() (string, string, error) {
+	secret := generateToken()
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", err
+	}
+	return secret, string(hash), nil
+}
+
+func (cs *ClientStore) Register(client *OAuthClient, secret string) error {
+	if err := prepareClient(client, secret); err != nil {
+		return err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if _, exists := cs.clients[client.ID]; exists {
+		return errClientExists
+	}
+	cs.clients[client.ID] = client
+	return nil
+}
+
+func (cs *ClientStore) Configure(client *OAuthClient, secret string) error {
+	if err := prepareClient(client, secret); err != nil {
+		return err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.clients[client.ID] = client
+	return nil
+}
+
+func (cs *ClientStore) Get(id string) (*OAuthClient, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	client, exists := cs.clients[id]
+	return client, exists
+}
+
+// RotateSecret replaces a confidential client's secret and returns the new
+// one. The old secret stops working immediately.
+func (cs *ClientStore) RotateSecret(id string) (string, error) {
+	secret, hash, err := newClientSecret()
+	if err != nil {
+		return "", err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	client, exists := cs.clients[id]
+	if !exists || client.Public {
+		return "", errClientNotFound
+	}
+	updated := *client
+	updated.SecretHash = hash
+	cs.clients[id] = &updated
+	return secret, nil
+}
+
+// SetDisabled blocks or re-enables a client.
+func (cs *ClientStore) SetDisabled(id string, disabled bool) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	client, exists := cs.clients[id]
+	if !exists {
+		return errClientNotFound
+	}
+	updated := *client
+	updated.Disabled = disabled
+	cs.clients[id] = &updated
+	return nil
+}
+
+// checkClientSecret authenticates a confidential client by its secret.
+func checkClientSecret(id, secret string) (*OAuthClient, bool) {
+	client, exists := clientStore.Get(id)
+	if !exists || client.Disabled || client.SecretHash == "" {
+		return nil, false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(secret)); err != nil {
+		return nil, false
+	}
+	return client, true
+}
+
+// loadClientsFromEnv registers the clients listed in OAUTH_CLIENTS as
+// comma-separated id:secret pairs (an entry without a secret is a public
+// client), then those in the JSON file named by OAUTH_CLIENTS_FILE. The
+// configuration wins over what durable storage kept from the last run.
+func loadClientsFromEnv() error {
+	configured := make(map[string]bool)
+	configure := func(client *OAuthClient, secret string) error {
+		if configured[client.ID] {
+			return fmt.Errorf("client %s: %w", client.ID, errClientExists)
+		}
+		configured[client.ID] = true
+		if err := clientStore.Configure(client, secret); err != nil {
+			return fmt.Errorf("client %s: %w", client.ID, err)
+		}
+		return nil
+	}
+
+	for _, entry := range strings.Split(os.Getenv("OAUTH_CLIENTS"), ",") {
+		id, secret, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		if id == "" {
+			continue
+		}
+		if err := configure(&OAuthClient{ID: id, Name: id}, secret); err != nil {
+			return err
+		}
+	}
+
+	path := os.Getenv("OAUTH_CLIENTS_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var configs []struct {
+		ID            string          `json:"client_id"`
+		Name          string          `json:"client_name"`
+		Secret        string          `json:"client_secret"`
+		RedirectURIs  []string        `json:"redirect_uris"`
+		Scopes        []string        `json:"scopes"`
+		TokenExchange *ExchangePolicy `json:"token_exchange"`
+	}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, c := range configs {
+		client := &OAuthClient{
+			ID:            c.ID,
+			Name:          c.Name,
+			RedirectURIs:  c.RedirectURIs,
+			Scopes:        c.Scopes,
+			TokenExchange: c.TokenExchange,
+		}
+		if err := configure(client, c.Secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clientCredentials extracts client_id and client_secret from HTTP Basic
+// auth or, failing that, from the form body (RFC 6749 section 2.3.1).
+func clientCredentials(r *http.Request) (string, string) {
+	if id, secret, ok := r.BasicAuth(); ok {
+		// Basic credentials are form-encoded before being base64'd
+		if unescaped, err := url.QueryUnescape(id); err == nil {
+			id = unescaped
+		}
+		if unescaped, err := url.QueryUnescape(secret); err == nil {
+			secret = unescaped
+		}
+		return id, secret
+	}
+	return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+}
+
+// authenticateClient authenticates the confidential client making the
+// request. The form must already be parsed.
+func authenticateClient(r *http.Request) (*OAuthClient, bool) {
+	id, secret := clientCredentials(r)
+	if id == "" || secret == "" {
+		return nil, false
+	}
+	return checkClientSecret(id, secret)
+}
+
+// identifyClient authenticates confidential clients by secret and accepts
+// public clients on client_id alone.
+func identifyClient(r *http.Request) (*OAuthClient, bool) {
+	id, secret := clientCredentials(r)
+	client, exists := clientStore.Get(id)
+	if !exists || client.Disabled {
+		return nil, false
+	}
+	if client.Public {
+		return client, secret == ""
+	}
+	return checkClientSecret(id, secret)
+}
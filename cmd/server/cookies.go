@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Browser clients can ask for cookie transport with this header on any
+// sign-in or refresh. Tokens then go into HttpOnly cookies instead of the
+// response body, so page scripts never see them.
+const (
+	sessionTransportHeader = "X-Session-Transport"
+	csrfHeader             = "X-CSRF-Token"
+)
+
+// cookieConfig is set from COOKIE_SECURE and COOKIE_SAMESITE. Secure
+// cookies get the __Host- or __Secure- name prefix, which stops
+// subdomains from planting their own.
+var cookieConfig = struct {
+	Secure   bool
+	SameSite http.SameSite
+}{
+	Secure:   true,
+	SameSite: http.SameSiteLaxMode,
+}
+
+func loadCookieConfigFromEnv() error {
+	switch secure := getEnv("COOKIE_SECURE", "true"); secure {
+	case "true":
+		cookieConfig.Secure = true
+	case "false":
+		cookieConfig.Secure = false
+	default:
+		return fmt.Errorf("invalid COOKIE_SECURE %q", secure)
+	}
+
+	switch sameSite := strings.ToLower(getEnv("COOKIE_SAMESITE", "lax")); sameSite {
+	case "strict":
+		cookieConfig.SameSite = http.SameSiteStrictMode
+	case "lax":
+		cookieConfig.SameSite = http.SameSiteLaxMode
+	case "none":
+		if !cookieConfig.Secure {
+			return fmt.Errorf("COOKIE_SAMESITE=none requires COOKIE_SECURE=true")
+		}
+		cookieConfig.SameSite = http.SameSiteNoneMode
+	default:
+		return fmt.Errorf("invalid COOKIE_SAMESITE %q", sameSite)
+	}
+	return nil
+}
+
+// The access token and CSRF cookies are sent on every request; the refresh
+// token only to the refresh endpoint.
+func sessionCookieName() string {
+	if cookieConfig.Secure {
+		return "__Host-session"
+	}
+	return "session"
+}
+
+func csrfCookieName() string {
+	if cookieConfig.Secure {
+		return "__Host-csrf"
+	}
+	return "csrf"
+}
+
+func refreshCookieName() string {
+	if cookieConfig.Secure {
+		return "__Secure-refresh"
+	}
+	return "refresh"
+}
+
+const refreshCookiePath = "/api/auth/refresh"
+
+// wantsCookieTransport reports whether the client asked for its tokens as
+// cookies.
+func wantsCookieTransport(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get(sessionTransportHeader), "cookie")
+}
+
+// setSessionCookies stores the tokens in cookies along with a fresh CSRF
+// token, which is returned for the response body.
+func setSessionCookies(w http.ResponseWriter, token Token) string {
+	csrfToken := generateToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName(),
+		Value:    token.AccessToken,
+		Path:     "/",
+		MaxAge:   token.ExpiresIn,
+		HttpOnly: true,
+		Secure:   cookieConfig.Secure,
+		SameSite: cookieConfig.SameSite,
+	})
+	if token.RefreshToken != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     refreshCookieName(),
+			Value:    token.RefreshToken,
+			Path:     refreshCookiePath,
+			MaxAge:   int(refreshTokenTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   cookieConfig.Secure,
+			SameSite: cookieConfig.SameSite,
+		})
+	}
+	// Readable by scripts, which echo it back in X-CSRF-Token
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName(),
+		Value:    csrfToken,
+		Path:     "/",
+		MaxAge:   int(refreshTokenTTL.Seconds()),
+		Secure:   cookieConfig.Secure,
+		SameSite: cookieConfig.SameSite,
+	})
+	return csrfToken
+}
+
+// clearSessionCookies expires every cookie setSessionCookies sets.
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, c := range []struct{ name, path string }{
+		{sessionCookieName(), "/"},
+		{refreshCookieName(), refreshCookiePath},
+		{csrfCookieName(), "/"},
+	} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     c.name,
+			Path:     c.path,
+			MaxAge:   -1,
+			HttpOnly: c.name != csrfCookieName(),
+			Secure:   cookieConfig.Secure,
+			SameSite: cookieConfig.SameSite,
+		})
+	}
+}
+
+// checkCSRF implements the double-submit check for cookie-authenticated
+// requests: anything but a safe method must repeat the CSRF cookie in the
+// X-CSRF-Token header, which a cross-site page can neither read nor set.
+func checkCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	cookie, err := r.Cookie(csrfCookieName())
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	header := r.Header.Get(csrfHeader)
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
+
+// cookieSignInResponse replaces the token body under cookie transport.
+type cookieSignInResponse struct {
+	TokenType          string `json:"token_type"`
+	ExpiresIn          int    `json:"expires_in"`
+	CSRFToken          string `json:"csrf_token"`
+	TrustedDeviceToken string `json:"trusted_device_token,omitempty"`
+}
+
+// writeSignInResponse sends the tokens of a first-party sign-in or
+// refresh, as cookies if useCookies is set and in the body otherwise.
+func writeSignInResponse(w http.ResponseWriter, token Token, trustedDeviceToken string, useCookies bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !useCookies {
+		json.NewEncoder(w).Encode(trustedLoginResponse{Token: token, TrustedDeviceToken: trustedDeviceToken})
+		return
+	}
+
+	csrfToken := setSessionCookies(w, token)
+	json.NewEncoder(w).Encode(cookieSignInResponse{
+		TokenType:          "cookie",
+		ExpiresIn:          token.ExpiresIn,
+		CSRFToken:          csrfToken,
+		TrustedDeviceToken: trustedDeviceToken,
+	})
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceCodeTTL       = 10 * time.Minute
+	devicePollInterval  = 5 * time.Second
+	// userCodeAlphabet leaves out vowels and look-alike characters (RFC 8628
+	// section 6.1)
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	// After deviceUserCodeMaxMisses invalid user codes a user can't enter
+	// any more until deviceCodeTTL has passed since the first, so codes
+	// can't be guessed (RFC 8628 section 5.1)
+	deviceUserCodeMaxMisses = 5
+)
+
+// DeviceAuthorization tracks one device flow from the device's first
+// request until it collects its tokens.
+type DeviceAuthorization struct {
+	DeviceCode   string
+	UserCode     string
+	ClientID     string
+	Scope        string
+	UserID       string
+	AuthTime     time.Time
+	AMR          []string
+	Approved     bool
+	Denied       bool
+	Interval     time.Duration
+	LastPolledAt time.Time
+	ExpiresAt    time.Time
+}
+
+// userCodeMisses counts the invalid user codes one user has entered.
+type userCodeMisses struct {
+	Count int
+	Since time.Time
+}
+
+var deviceAuthorizations = &struct {
+	mu           sync.Mutex
+	byDeviceCode map[string]*DeviceAuthorization
+	byUserCode   map[string]*DeviceAuthorization
+	misses       map[string]*userCodeMisses // user ID -> misses
+}{
+	byDeviceCode: make(map[string]*DeviceAuthorization),
+	byUserCode:   make(map[string]*DeviceAuthorization),
+	misses:       make(map[string]*userCodeMisses),
+}
+
+// deleteExpiredDeviceAuthorizations drops flows whose device never came
+// back for its tokens, and invalid user code counts that have run out.
+func deleteExpiredDeviceAuthorizations(now time.Time) int {
+	deviceAuthorizations.mu.Lock()
+	defer deviceAuthorizations.mu.Unlock()
+
+	n := 0
+	for deviceCode, da := range deviceAuthorizations.byDeviceCode {
+		if now.After(da.ExpiresAt) {
+			delete(deviceAuthorizations.byDeviceCode, deviceCode)
+			if deviceAuthorizations.byUserCode[da.UserCode] == da {
+				delete(deviceAuthorizations.byUserCode, da.UserCode)
+			}
+			n++
+		}
+	}
+	for userID, m := range deviceAuthorizations.misses {
+		if now.Sub(m.Since) > deviceCodeTTL {
+			delete(deviceAuthorizations.misses, userID)
+			n++
+		}
+	}
+	return n
+}
+
+var devicePage = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Connect a device</title></head>
+<body>
+<h1>Connect a device</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if not .Done}}
+<form method="POST" action="/oauth/device">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<p><label>Code <input type="text" name="user_code" value="{{.UserCode}}" required autocomplete="off"></label></p>
+<p><label>Email <input type="email" name="email" required></label></p>
+<p><label>Password <input type="password" name="password" required></label></p>
+<p><label>Authentication code (if enabled) <input type="text" name="otp" autocomplete="one-time-code"></label></p>
+<button type="submit" name="action" value="approve">Allow</button>
+<button type="submit" name="action" value="deny">Deny</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// deviceAuthorizationHandler starts a device flow (RFC 8628 section 3.1).
+func deviceAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid form body")
+		return
+	}
+
+	client, ok := identifyClient(r)
+	if !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	scope := r.PostForm.Get("scope")
+	if scope == "" {
+		scope = strings.Join(client.Scopes, " ")
+	}
+	if !scopeSubset(parseScope(scope), client.Scopes) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "Requested scope is not allowed for this client")
+		return
+	}
+
+	userCode, err := generateUserCode()
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to generate user code")
+		return
+	}
+	da := &DeviceAuthorization{
+		DeviceCode: generateToken(),
+		UserCode:   userCode,
+		ClientID:   client.ID,
+		Scope:      scope,
+		Interval:   devicePollInterval,
+		ExpiresAt:  time.Now().Add(deviceCodeTTL),
+	}
+
+	deviceAuthorizations.mu.Lock()
+	deviceAuthorizations.byDeviceCode[da.DeviceCode] = da
+	deviceAuthorizations.byUserCode[da.UserCode] = da
+	deviceAuthorizations.mu.Unlock()
+
+	verificationURI := jwtIssuer.issuer + "/oauth/device"
+	displayCode := userCode[:4] + "-" + userCode[4:]
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_code":               da.DeviceCode,
+		"user_code":                 displayCode,
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?user_code=" + url.QueryEscape(displayCode),
+		"expires_in":                int(deviceCodeTTL.Seconds()),
+		"interval":                  int(devicePollInterval.Seconds()),
+	})
+}
+
+// deviceVerificationHandler is the page where a user signs in and approves
+// or denies the code shown on their device.
+func deviceVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page := struct {
+		UserCode  string
+		CSRFToken string
+		Message   string
+		Done      bool
+	}{UserCode: r.URL.Query().Get("user_code")}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	page.CSRFToken = deviceCSRFToken(w, r)
+
+	if r.Method == http.MethodGet {
+		devicePage.Execute(w, page)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	page.UserCode = r.PostForm.Get("user_code")
+
+	// Without this a cross-site form could approve an attacker's code with
+	// credentials the browser fills in
+	if subtle.ConstantTimeCompare([]byte(r.PostForm.Get("csrf_token")), []byte(page.CSRFToken)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		page.Message = "This page expired. Please try again"
+		devicePage.Execute(w, page)
+		return
+	}
+
+	user, err := authenticateUser(r, r.PostForm.Get("email"), r.PostForm.Get("password"))
+	if err != nil {
+		page.Message = loginFormError(err)
+		devicePage.Execute(w, page)
+		return
+	}
+	secondFactor, message := formSecondFactor(r, user.ID, r.PostForm.Get("otp"))
+	if message != "" {
+		page.Message = message
+		devicePage.Execute(w, page)
+		return
+	}
+	amr := append([]string{"pwd"}, secondFactor...)
+
+	now := time.Now()
+	userCode := normalizeUserCode(page.UserCode)
+	deviceAuthorizations.mu.Lock()
+	misses := deviceAuthorizations.misses[user.ID]
+	if misses != nil && now.Sub(misses.Since) > deviceCodeTTL {
+		delete(deviceAuthorizations.misses, user.ID)
+		misses = nil
+	}
+	if misses != nil && misses.Count >= deviceUserCodeMaxMisses {
+		deviceAuthorizations.mu.Unlock()
+		page.Message = "Too many invalid codes. Try again later"
+		devicePage.Execute(w, page)
+		return
+	}
+	da, exists := deviceAuthorizations.byUserCode[userCode]
+	if !exists || now.After(da.ExpiresAt) || da.Approved || da.Denied {
+		if misses == nil {
+			misses = &userCodeMisses{Since: now}
+			deviceAuthorizations.misses[user.ID] = misses
+		}
+		misses.Count++
+		deviceAuthorizations.mu.Unlock()
+		page.Message = "That code is invalid or has expired"
+		devicePage.Execute(w, page)
+		return
+	}
+	if r.PostForm.Get("action") == "approve" {
+		da.Approved = true
+		da.UserID = user.ID
+		da.AuthTime = now
+		da.AMR = amr
+		page.Message = "Device connected. You can return to your device."
+	} else {
+		da.Denied = true
+		page.Message = "Request denied."
+	}
+	// A user code is only good for one decision
+	delete(deviceAuthorizations.byUserCode, userCode)
+	deviceAuthorizations.mu.Unlock()
+
+	page.Done = true
+	devicePage.Execute(w, page)
+}
+
+// deviceCSRFCookieName names the double-submit cookie of the verification
+// page; like the session cookies it gets the __Host- prefix when secure.
+func deviceCSRFCookieName() string {
+	if cookieConfig.Secure {
+		return "__Host-device-csrf"
+	}
+	return "device-csrf"
+}
+
+// deviceCSRFToken returns the token the verification form must post back,
+// setting the cookie it is checked against if the browser has none yet.
+func deviceCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(deviceCSRFCookieName()); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	token := generateToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceCSRFCookieName(),
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   cookieConfig.Secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// deviceCodeGrant answers a device's poll on the token endpoint.
+func deviceCodeGrant(w http.ResponseWriter, r *http.Request, client *OAuthClient) {
+	deviceCode := r.PostForm.Get("device_code")
+
+	deviceAuthorizations.mu.Lock()
+	da, exists := deviceAuthorizations.byDeviceCode[deviceCode]
+	if !exists || da.ClientID != client.ID {
+		deviceAuthorizations.mu.Unlock()
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid device code")
+		return
+	}
+
+	now := time.Now()
+	if now.After(da.ExpiresAt) {
+		delete(deviceAuthorizations.byDeviceCode, deviceCode)
+		delete(deviceAuthorizations.byUserCode, da.UserCode)
+		deviceAuthorizations.mu.Unlock()
+		writeOAuthError(w, http.StatusBadRequest, "expired_token", "The device code has expired")
+		return
+	}
+
+	// Polling faster than the interval backs the device off by 5 seconds
+	// (RFC 8628 section 3.5)
+	if !da.LastPolledAt.IsZero() && now.Sub(da.LastPolledAt) < da.Interval {
+		da.Interval += 5 * time.Second
+		da.LastPolledAt = now
+		deviceAuthorizations.mu.Unlock()
+		writeOAuthError(w, http.StatusBadRequest, "slow_down", "Polling too frequently")
+		return
+	}
+	da.LastPolledAt = now
+
+	switch {
+	case da.Denied:
+		delete(deviceAuthorizations.byDeviceCode, deviceCode)
+		deviceAuthorizations.mu.Unlock()
+		writeOAuthError(w, http.StatusBadRequest, "access_denied", "The user denied the request")
+		return
+	case !da.Approved:
+		deviceAuthorizations.mu.Unlock()
+		writeOAuthError(w, http.StatusBadRequest, "authorization_pending", "The user has not yet approved the request")
+		return
+	}
+	delete(deviceAuthorizations.byDeviceCode, deviceCode)
+	deviceAuthorizations.mu.Unlock()
+
+	token, err := issueTokens(r, Grant{
+		UserID:   da.UserID,
+		ClientID: client.ID,
+		Scope:    da.Scope,
+		AuthTime: da.AuthTime,
+		AMR:      da.AMR,
+	})
+	if err == errSessionLimitReached {
+		writeOAuthError(w, http.StatusBadRequest, "access_denied", "Maximum number of active sessions reached")
+		return
+	}
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to issue token")
+		return
+	}
+	writeTokenResponse(w, token)
+}
+
+func generateUserCode() (string, error) {
+	code := make([]byte, 8)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// normalizeUserCode accepts codes typed in any case, with or without the
+// dash and spaces.
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func postDevicePage(form url.Values, csrfCookie string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/oauth/device", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if csrfCookie != "" {
+		r.AddCookie(&http.Cookie{Name: deviceCSRFCookieName(), Value: csrfCookie})
+	}
+	w := httptest.NewRecorder()
+	deviceVerificationHandler(w, r)
+	return w
+}
+
+func TestDevicePageRequiresCSRFToken(t *testing.T) {
+	w := httptest.NewRecorder()
+	deviceVerificationHandler(w, httptest.NewRequest(http.MethodGet, "/oauth/device", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !strings.Contains(w.Body.String(), cookies[0].Value) {
+		t.Fatal("form not given the CSRF token of its cookie")
+	}
+
+	form := url.Values{"user_code": {"BCDFGHJK"}, "csrf_token": {cookies[0].Value}}
+	if w := postDevicePage(form, ""); w.Code != http.StatusForbidden {
+		t.Errorf("POST without cookie: got %d", w.Code)
+	}
+	if w := postDevicePage(form, "other-token"); w.Code != http.StatusForbidden {
+		t.Errorf("POST with mismatched cookie: got %d", w.Code)
+	}
+}
+
+func TestDevicePageLocksAfterInvalidCodes(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("device-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{ID: "device-guess-user", Email: "device-guess@example.com", PasswordHash: string(hash), CreatedAt: time.Now()}
+	if err := store.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	da := &DeviceAuthorization{DeviceCode: "device-guess-code", UserCode: "GSSDVCCD", ExpiresAt: time.Now().Add(deviceCodeTTL)}
+	deviceAuthorizations.mu.Lock()
+	deviceAuthorizations.byDeviceCode[da.DeviceCode] = da
+	deviceAuthorizations.byUserCode[da.UserCode] = da
+	deviceAuthorizations.mu.Unlock()
+	t.Cleanup(func() {
+		deviceAuthorizations.mu.Lock()
+		delete(deviceAuthorizations.byDeviceCode, da.DeviceCode)
+		delete(deviceAuthorizations.byUserCode, da.UserCode)
+		delete(deviceAuthorizations.misses, user.ID)
+		deviceAuthorizations.mu.Unlock()
+	})
+
+	form := url.Values{
+		"email":      {user.Email},
+		"password":   {"device-password"},
+		"csrf_token": {"device-csrf"},
+		"action":     {"approve"},
+	}
+	for i := 0; i < deviceUserCodeMaxMisses; i++ {
+		form.Set("user_code", "BCDF-GHJ"+string(userCodeAlphabet[i]))
+		if w := postDevicePage(form, "device-csrf"); !strings.Contains(w.Body.String(), "invalid or has expired") {
+			t.Fatalf("miss %d: %q", i, w.Body.String())
+		}
+	}
+
+	// Even the right code is refused once the user has guessed too often
+	form.Set("user_code", da.UserCode)
+	postDevicePage(form, "device-csrf")
+	deviceAuthorizations.mu.Lock()
+	approved := da.Approved
+	deviceAuthorizations.mu.Unlock()
+	if approved {
+		t.Fatal("code approved after too many invalid codes")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+)
+
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// ExchangePolicy controls what a client may obtain through token exchange.
+// Impersonation issues a token that is indistinguishable from the subject's
+// own; delegation records the actor in the act claim.
+type ExchangePolicy struct {
+	Audiences     []string `json:"audiences"`
+	Impersonation bool     `json:"impersonation"`
+	Delegation    bool     `json:"delegation"`
+}
+
+func (p *ExchangePolicy) allowsAudience(audience string) bool {
+	for _, allowed := range p.Audiences {
+		if audience == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenExchangeGrant implements RFC 8693 for access tokens this server
+// issued. Without an actor_token the exchange is impersonation; with one it
+// is delegation.
+func tokenExchangeGrant(w http.ResponseWriter, r *http.Request, client *OAuthClient) {
+	policy := client.TokenExchange
+	if client.Public || policy == nil {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "Client may not use token exchange")
+		return
+	}
+
+	if r.PostForm.Get("subject_token_type") != accessTokenType {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "subject_token_type must be an access token")
+		return
+	}
+	if requested := r.PostForm.Get("requested_token_type"); requested != "" && requested != accessTokenType {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Only access tokens can be requested")
+		return
+	}
+
+	subject, ok := activeAccessToken(r.PostForm.Get("subject_token"))
+	if !ok || subject.Subject == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid subject_token")
+		return
+	}
+
+	audience := r.PostForm.Get("audience")
+	if audience == "" || !policy.allowsAudience(audience) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_target", "Audience is not allowed for this client")
+		return
+	}
+
+	// Exchanged tokens can only narrow what the subject token allowed
+	scope := r.PostForm.Get("scope")
+	ceiling := parseScope(subject.Scope)
+	if subject.Scope == "" {
+		ceiling = client.Scopes
+	}
+	if scope == "" {
+		scope = subject.Scope
+	}
+	if !scopeSubset(parseScope(scope), ceiling) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "Scope exceeds the subject token")
+		return
+	}
+
+	act := subject.Act
+	mode := "impersonation"
+	if actorToken := r.PostForm.Get("actor_token"); actorToken != "" {
+		if !policy.Delegation {
+			writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "Client may not use delegation")
+			return
+		}
+		if r.PostForm.Get("actor_token_type") != accessTokenType {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "actor_token_type must be an access token")
+			return
+		}
+		actor, ok := activeAccessToken(actorToken)
+		if !ok {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid actor_token")
+			return
+		}
+
+		// A service token has no user subject, so the service acts as itself
+		actorSubject := actor.Subject
+		if actorSubject == "" {
+			actorSubject = actor.ClientID
+		}
+		act = &Actor{Subject: actorSubject, Act: subject.Act}
+		mode = "delegation"
+	} else if !policy.Impersonation {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "Client may not use impersonation")
+		return
+	}
+
+	token, err := issueAccessToken(r, Grant{
+		UserID:    subject.Subject,
+		ClientID:  client.ID,
+		Scope:     scope,
+		Audience:  audience,
+		Act:       act,
+		Exchanged: true,
+	})
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to issue token")
+		return
+	}
+	token.IssuedTokenType = accessTokenType
+
+	details := map[string]interface{}{
+		"client_id": client.ID,
+		"audience":  audience,
+		"mode":      mode,
+	}
+	if act != nil {
+		details["actor"] = act.Subject
+	}
+	auditLogger.Log(subject.Subject, "token_exchange", "access_token", r.RemoteAddr, details)
+
+	writeTokenResponse(w, token)
+}
+
+// activeAccessToken verifies an access token for any audience and checks it
+// has not been revoked.
+func activeAccessToken(token string) (*Claims, bool) {
+	claims, err := jwtIssuer.VerifyAnyAudience(token)
+	if err != nil {
+		return nil, false
+	}
+	if _, exists := sessionStore.Get(token); !exists {
+		return nil, false
+	}
+	return claims, true
+}
@@ -0,0 +1,946 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+)
+
+// fileStorage keeps users, sessions, tokens, second factors and OAuth
+// clients in the in-memory stores and
+// makes them durable with an append-only log in dir. Every mutation is
+// applied and then logged, with an fsync, before the caller sees it
+// succeed. Periodic compaction writes a snapshot of the full state and
+// truncates the log. On startup the snapshot is loaded and the log replayed
+// on top of it.
+//
+// Log records are whole values ("put") or deletions, so replaying a record
+// twice gives the same result. That keeps a crash between writing a
+// snapshot and truncating the log harmless.
+type fileStorage struct {
+	// mu orders mutations with their log records; reads go straight to the
+	// in-memory stores
+	mu      sync.Mutex
+	dir     string
+	wal     *os.File
+	pending int
+	stop    chan struct{}
+	done    chan struct{}
+
+	users              *UserStore
+	sessions           *SessionStore
+	refreshTokens      *RefreshTokenStore
+	resetTokens        *ResetTokenStore
+	verificationTokens *VerificationTokenStore
+	mfa                *MFAStore
+	passkeys           *PasskeyStore
+	trustedDevices     *TrustedDeviceStore
+	clients            *ClientStore
+}
+
+// walRecord is one line of the log, written as the CRC-32 of the JSON
+// in hex, a space, and the JSON.
+type walRecord struct {
+	Op   string          `json:"op"`
+	Data json.RawMessage `json:"data"`
+}
+
+// userRecord is a User with its password hash, which User hides from JSON.
+type userRecord struct {
+	ID            string    `json:"id"`
+	Email         string    `json:"email"`
+	PasswordHash  string    `json:"password_hash"`
+	Name          string    `json:"name"`
+	EmailVerified bool      `json:"email_verified"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type refreshTokenRecord struct {
+	Token        string     `json:"token"`
+	Info         *TokenInfo `json:"info"`
+	SessionToken string     `json:"session_token,omitempty"`
+}
+
+type rotateRecord struct {
+	Token     string    `json:"token"`
+	RotatedAt time.Time `json:"rotated_at"`
+}
+
+type touchRecord struct {
+	Token      string    `json:"token"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type keyRecord struct {
+	Key string `json:"key"`
+}
+
+// trustedDeviceRecord is a TrustedDevice with the fields it hides from JSON.
+type trustedDeviceRecord struct {
+	ID         string    `json:"id"`
+	TokenHash  string    `json:"token_hash"`
+	UserID     string    `json:"user_id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type revokeDeviceRecord struct {
+	UserID string `json:"user_id"`
+	ID     string `json:"id"`
+}
+
+type fileSnapshot struct {
+	Users              []userRecord          `json:"users"`
+	Sessions           []*Session            `json:"sessions"`
+	RefreshTokens      map[string]*TokenInfo `json:"refresh_tokens"`
+	TokenFamilies      []*TokenFamily        `json:"token_families"`
+	ResetTokens        []*PasswordResetToken `json:"reset_tokens"`
+	VerificationTokens []*VerificationToken  `json:"verification_tokens"`
+	MFAEnrollments     []*MFAEnrollment      `json:"mfa_enrollments"`
+	Passkeys           []*WebAuthnCredential `json:"passkeys"`
+	TrustedDevices     []trustedDeviceRecord `json:"trusted_devices"`
+	Clients            []*OAuthClient        `json:"clients"`
+}
+
+// openFileStorage loads the state saved in dir, creating the directory if
+// needed, and opens the log for appending.
+func openFileStorage(dir string) (*fileStorage, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	fs := &fileStorage{
+		dir:                dir,
+		stop:               make(chan struct{}),
+		done:               make(chan struct{}),
+		users:              &UserStore{users: make(map[string]*User), byEmail: make(map[string]string)},
+		sessions:           &SessionStore{sessions: make(map[string]*Session)},
+		refreshTokens:      &RefreshTokenStore{tokens: make(map[string]*TokenInfo), families: make(map[string]*TokenFamily)},
+		resetTokens:        &ResetTokenStore{tokens: make(map[string]*PasswordResetToken)},
+		verificationTokens: &VerificationTokenStore{tokens: make(map[string]*VerificationToken)},
+		mfa:                &MFAStore{enrollments: make(map[string]*MFAEnrollment)},
+		passkeys:           &PasskeyStore{credentials: make(map[string]*WebAuthnCredential)},
+		trustedDevices:     &TrustedDeviceStore{devices: make(map[string]*TrustedDevice)},
+		clients:            &ClientStore{clients: make(map[string]*OAuthClient)},
+	}
+
+	if err := fs.loadSnapshot(); err != nil {
+		return nil, fmt.Errorf("load snapshot: %w", err)
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.replay(wal); err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("replay %s: %w", walFileName, err)
+	}
+	fs.wal = wal
+	return fs, nil
+}
+
+func (fs *fileStorage) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(fs.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap fileSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+
+	for i := range snap.Users {
+		u := User(snap.Users[i])
+		if err := fs.users.Create(&u); err != nil {
+			return fmt.Errorf("user %s: %w", u.ID, err)
+		}
+	}
+	for _, session := range snap.Sessions {
+		fs.sessions.sessions[session.Token] = session
+	}
+	for token, info := range snap.RefreshTokens {
+		fs.refreshTokens.tokens[token] = info
+	}
+	for _, family := range snap.TokenFamilies {
+		// Older snapshots list every session the family ever had
+		if n := len(family.Sessions); n > 1 {
+			family.Sessions = family.Sessions[n-1:]
+		}
+		fs.refreshTokens.families[family.ID] = family
+	}
+	for _, token := range snap.ResetTokens {
+		fs.resetTokens.tokens[token.Token] = token
+	}
+	for _, token := range snap.VerificationTokens {
+		fs.verificationTokens.tokens[token.Token] = token
+	}
+	for _, e := range snap.MFAEnrollments {
+		fs.mfa.enrollments[e.UserID] = e
+	}
+	for _, cred := range snap.Passkeys {
+		fs.passkeys.credentials[cred.ID] = cred
+	}
+	for i := range snap.TrustedDevices {
+		device := TrustedDevice(snap.TrustedDevices[i])
+		fs.trustedDevices.devices[device.TokenHash] = &device
+	}
+	for _, client := range snap.Clients {
+		fs.clients.clients[client.ID] = client
+	}
+	return nil
+}
+
+// replay applies every record in the log. A damaged final record is what a
+// crash mid-append leaves behind, so it is cut off; damage anywhere else is
+// an error.
+func (fs *fileStorage) replay(wal *os.File) error {
+	reader := bufio.NewReader(wal)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Discarding incomplete record at the end of %s", walFileName)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		rec, decodeErr := decodeWALRecord(line)
+		if decodeErr != nil {
+			if _, err := reader.Peek(1); err == io.EOF {
+				log.Printf("Discarding damaged record at the end of %s: %v", walFileName, decodeErr)
+				break
+			}
+			return fmt.Errorf("record at offset %d: %w", offset, decodeErr)
+		}
+		if err := fs.apply(rec); err != nil {
+			return fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+		offset += int64(len(line))
+		fs.pending++
+	}
+
+	if err := wal.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := wal.Seek(offset, io.SeekStart)
+	return err
+}
+
+func decodeWALRecord(line []byte) (walRecord, error) {
+	var rec walRecord
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	sum, payload, ok := bytes.Cut(line, []byte(" "))
+	if !ok {
+		return rec, errors.New("malformed record")
+	}
+	if fmt.Sprintf("%08x", crc32.ChecksumIEEE(payload)) != string(sum) {
+		return rec, errors.New("checksum mismatch")
+	}
+	err := json.Unmarshal(payload, &rec)
+	return rec, err
+}
+
+func (fs *fileStorage) apply(rec walRecord) error {
+	switch rec.Op {
+	case "user.put":
+		var u userRecord
+		if err := json.Unmarshal(rec.Data, &u); err != nil {
+			return err
+		}
+		user := User(u)
+		if _, exists := fs.users.GetByID(user.ID); exists {
+			return fs.users.Update(&user)
+		}
+		return fs.users.Create(&user)
+	case "session.put":
+		var session Session
+		if err := json.Unmarshal(rec.Data, &session); err != nil {
+			return err
+		}
+		return fs.sessions.Create(&session)
+	case "session.touch":
+		var r touchRecord
+		if err := json.Unmarshal(rec.Data, &r); err != nil {
+			return err
+		}
+		fs.sessions.Touch(r.Token, r.LastSeenAt, r.ExpiresAt)
+	case "session.delete":
+		var key keyRecord
+		if err := json.Unmarshal(rec.Data, &key); err != nil {
+			return err
+		}
+		fs.sessions.Delete(key.Key)
+	case "refresh.put":
+		var r refreshTokenRecord
+		if err := json.Unmarshal(rec.Data, &r); err != nil {
+			return err
+		}
+		return fs.refreshTokens.Store(r.Token, r.Info, r.SessionToken)
+	case "refresh.rotate":
+		var r rotateRecord
+		if err := json.Unmarshal(rec.Data, &r); err != nil {
+			return err
+		}
+		if info, exists := fs.refreshTokens.tokens[r.Token]; exists {
+			info.RotatedAt = r.RotatedAt
+		}
+	case "refresh.delete":
+		var key keyRecord
+		if err := json.Unmarshal(rec.Data, &key); err != nil {
+			return err
+		}
+		fs.refreshTokens.Revoke(key.Key)
+	case "refresh.delete_family":
+		var key keyRecord
+		if err := json.Unmarshal(rec.Data, &key); err != nil {
+			return err
+		}
+		fs.refreshTokens.RevokeFamily(key.Key)
+	case "reset.put":
+		var token PasswordResetToken
+		if err := json.Unmarshal(rec.Data, &token); err != nil {
+			return err
+		}
+		return fs.resetTokens.Create(&token)
+	case "reset.delete":
+		var key keyRecord
+		if err := json.Unmarshal(rec.Data, &key); err != nil {
+			return err
+		}
+		fs.resetTokens.Consume(key.Key)
+	case "verification.put":
+		var token VerificationToken
+		if err := json.Unmarshal(rec.Data, &token); err != nil {
+			return err
+		}
+		return fs.verificationTokens.Create(&token)
+	case "verification.delete":
+		var key keyRecord
+		if err := json.Unmarshal(rec.Data, &key); err != nil {
+			return err
+		}
+		fs.verificationTokens.Consume(key.Key)
+	case "mfa.put":
+		var e MFAEnrollment
+		if err := json.Unmarshal(rec.Data, &e); err != nil {
+			return err
+		}
+		fs.mfa.enrollments[e.UserID] = &e
+	case "mfa.delete":
+		var key keyRecord
+		if err := json.Unmarshal(rec.Data, &key); err != nil {
+			return err
+		}
+		fs.mfa.Disable(key.Key)
+	case "passkey.put":
+		var cred WebAuthnCredential
+		if err := json.Unmarshal(rec.Data, &cred); err != nil {
+			return err
+		}
+		fs.passkeys.credentials[cred.ID] = &cred
+	case "passkey.delete":
+		var key keyRecord
+		if err := json.Unmarshal(rec.Data, &key); err != nil {
+			return err
+		}
+		delete(fs.passkeys.credentials, key.Key)
+	case "trusted_device.put":
+		var r trustedDeviceRecord
+		if err := json.Unmarshal(rec.Data, &r); err != nil {
+			return err
+		}
+		device := TrustedDevice(r)
+		fs.trustedDevices.devices[device.TokenHash] = &device
+	case "trusted_device.revoke":
+		var r revokeDeviceRecord
+		if err := json.Unmarshal(rec.Data, &r); err != nil {
+			return err
+		}
+		fs.trustedDevices.Revoke(r.UserID, r.ID)
+	case "trusted_device.revoke_all":
+		var key keyRecord
+		if err := json.Unmarshal(rec.Data, &key); err != nil {
+			return err
+		}
+		fs.trustedDevices.RevokeAll(key.Key)
+	case "client.put":
+		var client OAuthClient
+		if err := json.Unmarshal(rec.Data, &client); err != nil {
+			return err
+		}
+		fs.clients.clients[client.ID] = &client
+	default:
+		return fmt.Errorf("unknown op %q", rec.Op)
+	}
+	return nil
+}
+
+// append writes a record and fsyncs the log. The caller must hold fs.mu.
+// The change is already visible in memory by then, so if it can't be made
+// durable we stop rather than carry on with state a restart would lose.
+func (fs *fileStorage) append(op string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err == nil {
+		payload, err = json.Marshal(walRecord{Op: op, Data: payload})
+	}
+	if err != nil {
+		log.Fatalf("Failed to encode %s record: %v", op, err)
+	}
+
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(payload), payload)
+	if _, err := fs.wal.WriteString(line); err != nil {
+		log.Fatalf("Failed to write %s: %v", walFileName, err)
+	}
+	if err := fs.wal.Sync(); err != nil {
+		log.Fatalf("Failed to sync %s: %v", walFileName, err)
+	}
+	fs.pending++
+}
+
+// compactEvery snapshots the state and truncates the log every interval
+// until Close is called.
+func (fs *fileStorage) compactEvery(interval time.Duration) {
+	defer close(fs.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := fs.compact(); err != nil {
+				log.Printf("Failed to compact storage: %v", err)
+			}
+		case <-fs.stop:
+			return
+		}
+	}
+}
+
+// Close stops compaction, takes a final snapshot so the next start has no
+// log to replay, and closes the log.
+func (fs *fileStorage) Close() error {
+	close(fs.stop)
+	<-fs.done
+	if err := fs.compact(); err != nil {
+		return err
+	}
+	return fs.wal.Close()
+}
+
+// compact writes a snapshot of everything that hasn't expired and empties
+// the log. Writes wait while it runs; reads don't.
+func (fs *fileStorage) compact() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.pending == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(fs.snapshot())
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(fs.dir, snapshotFileName)
+	if err := writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if err := syncDir(fs.dir); err != nil {
+		return err
+	}
+
+	if err := fs.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := fs.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := fs.wal.Sync(); err != nil {
+		return err
+	}
+	log.Printf("Compacted %d log records into %s", fs.pending, snapshotFileName)
+	fs.pending = 0
+	return nil
+}
+
+func (fs *fileStorage) snapshot() *fileSnapshot {
+	now := time.Now()
+	snap := &fileSnapshot{RefreshTokens: make(map[string]*TokenInfo)}
+
+	fs.users.mu.RLock()
+	for _, user := range fs.users.users {
+		snap.Users = append(snap.Users, userRecord(*user))
+	}
+	fs.users.mu.RUnlock()
+
+	fs.sessions.mu.RLock()
+	for _, session := range fs.sessions.sessions {
+		if now.Before(session.ExpiresAt) {
+			s := *session
+			snap.Sessions = append(snap.Sessions, &s)
+		}
+	}
+	fs.sessions.mu.RUnlock()
+
+	fs.refreshTokens.mu.RLock()
+	for token, info := range fs.refreshTokens.tokens {
+		if now.Before(info.ExpiresAt) {
+			i := *info
+			snap.RefreshTokens[token] = &i
+		}
+	}
+	for _, family := range fs.refreshTokens.families {
+		f := *family
+		f.Sessions = append([]string(nil), family.Sessions...)
+		snap.TokenFamilies = append(snap.TokenFamilies, &f)
+	}
+	fs.refreshTokens.mu.RUnlock()
+
+	fs.resetTokens.mu.Lock()
+	for _, token := range fs.resetTokens.tokens {
+		if now.Before(token.ExpiresAt) {
+			t := *token
+			snap.ResetTokens = append(snap.ResetTokens, &t)
+		}
+	}
+	fs.resetTokens.mu.Unlock()
+
+	fs.verificationTokens.mu.RLock()
+	for _, token := range fs.verificationTokens.tokens {
+		if now.Before(token.ExpiresAt) {
+			t := *token
+			snap.VerificationTokens = append(snap.VerificationTokens, &t)
+		}
+	}
+	fs.verificationTokens.mu.RUnlock()
+
+	fs.mfa.mu.Lock()
+	for _, e := range fs.mfa.enrollments {
+		copied := *e
+		copied.RecoveryCodes = append([]string(nil), e.RecoveryCodes...)
+		snap.MFAEnrollments = append(snap.MFAEnrollments, &copied)
+	}
+	fs.mfa.mu.Unlock()
+
+	fs.passkeys.mu.RLock()
+	for _, cred := range fs.passkeys.credentials {
+		c := *cred
+		snap.Passkeys = append(snap.Passkeys, &c)
+	}
+	fs.passkeys.mu.RUnlock()
+
+	fs.trustedDevices.mu.Lock()
+	for _, device := range fs.trustedDevices.devices {
+		if now.Before(device.ExpiresAt) {
+			snap.TrustedDevices = append(snap.TrustedDevices, trustedDeviceRecord(*device))
+		}
+	}
+	fs.trustedDevices.mu.Unlock()
+
+	fs.clients.mu.RLock()
+	for _, client := range fs.clients.clients {
+		snap.Clients = append(snap.Clients, client)
+	}
+	fs.clients.mu.RUnlock()
+
+	return snap
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// The repositories below wrap the in-memory stores, logging each mutation
+// that took effect. Reads come from the embedded store, as does
+// DeleteExpired: evicting expired entries needs no record, since replay
+// would only bring back entries that are already expired.
+
+type fileUserStore struct {
+	*UserStore
+	fs *fileStorage
+}
+
+func (s fileUserStore) Create(user *User) error {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if err := s.UserStore.Create(user); err != nil {
+		return err
+	}
+	s.fs.append("user.put", userRecord(*user))
+	return nil
+}
+
+func (s fileUserStore) Update(user *User) error {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if err := s.UserStore.Update(user); err != nil {
+		return err
+	}
+	s.fs.append("user.put", userRecord(*user))
+	return nil
+}
+
+type fileSessionStore struct {
+	*SessionStore
+	fs *fileStorage
+}
+
+func (s fileSessionStore) Create(session *Session) error {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if err := s.SessionStore.Create(session); err != nil {
+		return err
+	}
+	s.fs.append("session.put", session)
+	return nil
+}
+
+func (s fileSessionStore) Delete(token string) {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	s.SessionStore.Delete(token)
+	s.fs.append("session.delete", keyRecord{Key: token})
+}
+
+func (s fileSessionStore) Touch(token string, lastSeen, expiresAt time.Time) {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	s.SessionStore.Touch(token, lastSeen, expiresAt)
+	s.fs.append("session.touch", touchRecord{Token: token, LastSeenAt: lastSeen, ExpiresAt: expiresAt})
+}
+
+type fileRefreshTokenStore struct {
+	*RefreshTokenStore
+	fs *fileStorage
+}
+
+func (s fileRefreshTokenStore) Store(token string, info *TokenInfo, sessionToken string) error {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if err := s.RefreshTokenStore.Store(token, info, sessionToken); err != nil {
+		return err
+	}
+	s.fs.append("refresh.put", refreshTokenRecord{Token: token, Info: info, SessionToken: sessionToken})
+	return nil
+}
+
+func (s fileRefreshTokenStore) Rotate(token, clientID string) (*TokenInfo, error) {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	info, err := s.RefreshTokenStore.Rotate(token, clientID)
+	if err != nil {
+		return info, err
+	}
+	s.fs.append("refresh.rotate", rotateRecord{Token: token, RotatedAt: info.RotatedAt})
+	return info, nil
+}
+
+func (s fileRefreshTokenStore) RevokeFamily(familyID string) []string {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	sessions := s.RefreshTokenStore.RevokeFamily(familyID)
+	s.fs.append("refresh.delete_family", keyRecord{Key: familyID})
+	return sessions
+}
+
+func (s fileRefreshTokenStore) Revoke(token string) {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	s.RefreshTokenStore.Revoke(token)
+	s.fs.append("refresh.delete", keyRecord{Key: token})
+}
+
+type fileResetTokenStore struct {
+	*ResetTokenStore
+	fs *fileStorage
+}
+
+func (s fileResetTokenStore) Create(token *PasswordResetToken) error {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if err := s.ResetTokenStore.Create(token); err != nil {
+		return err
+	}
+	s.fs.append("reset.put", token)
+	return nil
+}
+
+func (s fileResetTokenStore) Consume(token string) (*PasswordResetToken, bool) {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	resetToken, ok := s.ResetTokenStore.Consume(token)
+	if ok {
+		s.fs.append("reset.delete", keyRecord{Key: token})
+	}
+	return resetToken, ok
+}
+
+type fileVerificationTokenStore struct {
+	*VerificationTokenStore
+	fs *fileStorage
+}
+
+func (s fileVerificationTokenStore) Create(token *VerificationToken) error {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if err := s.VerificationTokenStore.Create(token); err != nil {
+		return err
+	}
+	s.fs.append("verification.put", token)
+	return nil
+}
+
+func (s fileVerificationTokenStore) Consume(token string) (*VerificationToken, bool) {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	verificationToken, ok := s.VerificationTokenStore.Consume(token)
+	if ok {
+		s.fs.append("verification.delete", keyRecord{Key: token})
+	}
+	return verificationToken, ok
+}
+
+type fileMFAStore struct {
+	*MFAStore
+	fs *fileStorage
+}
+
+// logEnrollment records the user's enrollment as it now stands. The caller
+// must hold fs.mu.
+func (s fileMFAStore) logEnrollment(userID string) {
+	if e, exists := s.MFAStore.get(userID); exists {
+		s.fs.append("mfa.put", e)
+	}
+}
+
+func (s fileMFAStore) Begin(userID, secret string) error {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if err := s.MFAStore.Begin(userID, secret); err != nil {
+		return err
+	}
+	s.logEnrollment(userID)
+	return nil
+}
+
+func (s fileMFAStore) Confirm(userID, code string) ([]string, error) {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	codes, err := s.MFAStore.Confirm(userID, code)
+	if err != nil {
+		return nil, err
+	}
+	s.logEnrollment(userID)
+	return codes, nil
+}
+
+func (s fileMFAStore) VerifyTOTP(userID, code string) bool {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if !s.MFAStore.VerifyTOTP(userID, code) {
+		return false
+	}
+	s.logEnrollment(userID)
+	return true
+}
+
+func (s fileMFAStore) UseRecoveryCode(userID, code string) bool {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if !s.MFAStore.UseRecoveryCode(userID, code) {
+		return false
+	}
+	s.logEnrollment(userID)
+	return true
+}
+
+func (s fileMFAStore) Disable(userID string) {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	s.MFAStore.Disable(userID)
+	s.fs.append("mfa.delete", keyRecord{Key: userID})
+}
+
+type filePasskeyStore struct {
+	*PasskeyStore
+	fs *fileStorage
+}
+
+func (s filePasskeyStore) Add(cred *WebAuthnCredential) error {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if err := s.PasskeyStore.Add(cred); err != nil {
+		return err
+	}
+	s.fs.append("passkey.put", cred)
+	return nil
+}
+
+func (s filePasskeyStore) RecordUse(id string, signCount uint32) error {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if err := s.PasskeyStore.RecordUse(id, signCount); err != nil {
+		return err
+	}
+	if cred, exists := s.PasskeyStore.Get(id); exists {
+		s.fs.append("passkey.put", cred)
+	}
+	return nil
+}
+
+func (s filePasskeyStore) Delete(userID, id string) bool {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if !s.PasskeyStore.Delete(userID, id) {
+		return false
+	}
+	s.fs.append("passkey.delete", keyRecord{Key: id})
+	return true
+}
+
+type fileTrustedDeviceStore struct {
+	*TrustedDeviceStore
+	fs *fileStorage
+}
+
+func (s fileTrustedDeviceStore) Create(device *TrustedDevice) error {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if err := s.TrustedDeviceStore.Create(device); err != nil {
+		return err
+	}
+	s.fs.append("trusted_device.put", trustedDeviceRecord(*device))
+	return nil
+}
+
+func (s fileTrustedDeviceStore) Verify(token, userID, userAgent string) bool {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if !s.TrustedDeviceStore.Verify(token, userID, userAgent) {
+		return false
+	}
+	if device, exists := s.TrustedDeviceStore.get(hashTrustedDeviceToken(token)); exists {
+		s.fs.append("trusted_device.put", trustedDeviceRecord(device))
+	}
+	return true
+}
+
+func (s fileTrustedDeviceStore) Revoke(userID, id string) bool {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if !s.TrustedDeviceStore.Revoke(userID, id) {
+		return false
+	}
+	s.fs.append("trusted_device.revoke", revokeDeviceRecord{UserID: userID, ID: id})
+	return true
+}
+
+func (s fileTrustedDeviceStore) RevokeAll(userID string) {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	s.TrustedDeviceStore.RevokeAll(userID)
+	s.fs.append("trusted_device.revoke_all", keyRecord{Key: userID})
+}
+
+type fileClientStore struct {
+	*ClientStore
+	fs *fileStorage
+}
+
+// logClient records the client as it now stands. The caller must hold
+// fs.mu.
+func (s fileClientStore) logClient(id string) {
+	if client, exists := s.ClientStore.Get(id); exists {
+		s.fs.append("client.put", client)
+	}
+}
+
+func (s fileClientStore) Register(client *OAuthClient, secret string) error {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if err := s.ClientStore.Register(client, secret); err != nil {
+		return err
+	}
+	s.logClient(client.ID)
+	return nil
+}
+
+func (s fileClientStore) Configure(client *OAuthClient, secret string) error {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if err := s.ClientStore.Configure(client, secret); err != nil {
+		return err
+	}
+	s.logClient(client.ID)
+	return nil
+}
+
+func (s fileClientStore) RotateSecret(id string) (string, error) {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	secret, err := s.ClientStore.RotateSecret(id)
+	if err != nil {
+		return "", err
+	}
+	s.logClient(id)
+	return secret, nil
+}
+
+func (s fileClientStore) SetDisabled(id string, disabled bool) error {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	if err := s.ClientStore.SetDisabled(id, disabled); err != nil {
+		return err
+	}
+	s.logClient(id)
+	return nil
+}
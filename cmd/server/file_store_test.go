@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestFileStorage(t *testing.T, dir string) *fileStorage {
+	t.Helper()
+	fs, err := openFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.wal.Close() })
+	return fs
+}
+
+func createFileTestUser(t *testing.T, fs *fileStorage, id string) {
+	t.Helper()
+	user := &User{ID: id, Email: id + "@example.com", PasswordHash: "hash-" + id, CreatedAt: time.Now()}
+	if err := (fileUserStore{UserStore: fs.users, fs: fs}).Create(user); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func walSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestFileStorageReplaysLog(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStorage(t, dir)
+	sessions := fileSessionStore{SessionStore: fs.sessions, fs: fs}
+	mfa := fileMFAStore{MFAStore: fs.mfa, fs: fs}
+	clients := fileClientStore{ClientStore: fs.clients, fs: fs}
+
+	createFileTestUser(t, fs, "user-1")
+	now := time.Now()
+	for _, token := range []string{"kept", "deleted"} {
+		if err := sessions.Create(&Session{ID: token, UserID: "user-1", Token: token, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sessions.Delete("deleted")
+	if err := mfa.Begin("user-1", rfc6238Secret); err != nil {
+		t.Fatal(err)
+	}
+	code, _ := totpCode(rfc6238Secret, now.Unix()/totpPeriod)
+	if _, err := mfa.Confirm("user-1", code); err != nil {
+		t.Fatal(err)
+	}
+	if err := clients.Register(&OAuthClient{ID: "client-1", Name: "Test"}, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	fs.wal.Close()
+
+	fs = openTestFileStorage(t, dir)
+	if user, exists := fs.users.GetByID("user-1"); !exists || user.PasswordHash != "hash-user-1" {
+		t.Errorf("user not restored with its password hash: %+v", user)
+	}
+	if _, exists := fs.sessions.Get("kept"); !exists {
+		t.Error("session not restored")
+	}
+	if _, exists := fs.sessions.Get("deleted"); exists {
+		t.Error("deleted session restored")
+	}
+	if !fs.mfa.Enabled("user-1") {
+		t.Error("MFA enrollment not restored")
+	}
+	if e, _ := fs.mfa.get("user-1"); e.LastStep == 0 {
+		t.Error("last accepted TOTP step not restored")
+	}
+	if client, exists := fs.clients.Get("client-1"); !exists || client.SecretHash == "" {
+		t.Errorf("client not restored with its secret: %+v", client)
+	}
+}
+
+func TestFileStorageCompaction(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStorage(t, dir)
+	createFileTestUser(t, fs, "before")
+
+	// Keep the log as it was, as if the process died between writing the
+	// snapshot and truncating the log
+	stale, err := os.ReadFile(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if size := walSize(t, dir); size != 0 {
+		t.Fatalf("log is %d bytes after compaction, want 0", size)
+	}
+	createFileTestUser(t, fs, "after")
+	fs.wal.Close()
+
+	fs = openTestFileStorage(t, dir)
+	for _, id := range []string{"before", "after"} {
+		if _, exists := fs.users.GetByID(id); !exists {
+			t.Errorf("user %s not restored", id)
+		}
+	}
+	fs.wal.Close()
+
+	if err := os.WriteFile(filepath.Join(dir, walFileName), stale, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs = openTestFileStorage(t, dir)
+	if _, exists := fs.users.GetByID("before"); !exists {
+		t.Error("user lost replaying a log already in the snapshot")
+	}
+}
+
+func TestFileStorageDiscardsTornTail(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStorage(t, dir)
+	createFileTestUser(t, fs, "complete")
+	complete := walSize(t, dir)
+	createFileTestUser(t, fs, "torn")
+	fs.wal.Close()
+
+	// Cut the last record in half, as a crash mid-write would
+	path := filepath.Join(dir, walFileName)
+	if err := os.Truncate(path, complete+(walSize(t, dir)-complete)/2); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = openTestFileStorage(t, dir)
+	if _, exists := fs.users.GetByID("complete"); !exists {
+		t.Error("complete record lost")
+	}
+	if _, exists := fs.users.GetByID("torn"); exists {
+		t.Error("torn record applied")
+	}
+	if size := walSize(t, dir); size != complete {
+		t.Errorf("log is %d bytes, want the torn record cut off at %d", size, complete)
+	}
+
+	// New records follow the last good one
+	createFileTestUser(t, fs, "next")
+	fs.wal.Close()
+	fs = openTestFileStorage(t, dir)
+	if _, exists := fs.users.GetByID("next"); !exists {
+		t.Error("record written after recovery lost")
+	}
+}
+
+func TestFileStorageRejectsDamageBeforeTail(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestFileStorage(t, dir)
+	createFileTestUser(t, fs, "first")
+	createFileTestUser(t, fs, "second")
+	fs.wal.Close()
+
+	path := filepath.Join(dir, walFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[20] ^= 0xff
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs, err := openFileStorage(dir); err == nil {
+		fs.wal.Close()
+		t.Error("opened a log with a damaged record before its end")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// IntrospectionResponse is the RFC 7662 introspection result. Only Active is
+// set for tokens that are unknown, expired or revoked.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Subject   string `json:"sub,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	ID        string `json:"jti,omitempty"`
+	Act       *Actor `json:"act,omitempty"`
+}
+
+func introspectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid form body")
+		return
+	}
+
+	if _, ok := authenticateClient(r); !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	var resp IntrospectionResponse
+	if r.PostForm.Get("token_type_hint") == "refresh_token" {
+		resp = introspectRefreshToken(token)
+		if !resp.Active {
+			resp = introspectAccessToken(token)
+		}
+	} else {
+		resp = introspectAccessToken(token)
+		if !resp.Active {
+			resp = introspectRefreshToken(token)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func introspectAccessToken(token string) IntrospectionResponse {
+	claims, ok := activeAccessToken(token)
+	if !ok {
+		return IntrospectionResponse{}
+	}
+
+	return IntrospectionResponse{
+		Active:    true,
+		Subject:   claims.Subject,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		TokenType: "Bearer",
+		ExpiresAt: claims.ExpiresAt,
+		IssuedAt:  claims.IssuedAt,
+		Issuer:    claims.Issuer,
+		Audience:  claims.Audience,
+		ID:        claims.ID,
+		Act:       claims.Act,
+	}
+}
+
+func introspectRefreshToken(token string) IntrospectionResponse {
+	info, exists := refreshTokens.Get(token)
+	if !exists {
+		return IntrospectionResponse{}
+	}
+
+	return IntrospectionResponse{
+		Active:    true,
+		Subject:   info.UserID,
+		Scope:     info.Scope,
+		ClientID:  info.ClientID,
+		TokenType: "refresh_token",
+		ExpiresAt: info.ExpiresAt.Unix(),
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSweepExpiredEvictsShortLivedState(t *testing.T) {
+	now := time.Now()
+	expired := now.Add(-time.Second)
+
+	authCodes.mu.Lock()
+	authCodes.codes["janitor-code"] = &AuthorizationCode{Code: "janitor-code", ExpiresAt: expired}
+	authCodes.mu.Unlock()
+
+	da := &DeviceAuthorization{DeviceCode: "janitor-device", UserCode: "JNTRCODE", ExpiresAt: expired}
+	deviceAuthorizations.mu.Lock()
+	deviceAuthorizations.byDeviceCode[da.DeviceCode] = da
+	deviceAuthorizations.byUserCode[da.UserCode] = da
+	deviceAuthorizations.mu.Unlock()
+
+	mfaChallenges.mu.Lock()
+	mfaChallenges.challenges["janitor-mfa"] = &MFAChallenge{Token: "janitor-mfa", ExpiresAt: expired}
+	mfaChallenges.mu.Unlock()
+
+	webauthnCeremonies.mu.Lock()
+	webauthnCeremonies.ceremonies["janitor-ceremony"] = &webauthnCeremony{Challenge: "janitor-ceremony", ExpiresAt: expired}
+	webauthnCeremonies.mu.Unlock()
+
+	link := &MagicLink{Token: "janitor-link", Email: "janitor@example.com", ExpiresAt: expired}
+	magicLinks.mu.Lock()
+	magicLinks.tokens[link.Token] = link
+	magicLinks.byEmail[normalizeEmail(link.Email)] = link
+	magicLinks.mu.Unlock()
+
+	if err := trustedDevices.Create(&TrustedDevice{ID: "janitor-device", TokenHash: hashTrustedDeviceToken("janitor-device"), UserID: "janitor-user", ExpiresAt: expired}); err != nil {
+		t.Fatal(err)
+	}
+
+	sweepExpired(now)
+
+	authCodes.mu.Lock()
+	_, code := authCodes.codes["janitor-code"]
+	authCodes.mu.Unlock()
+	deviceAuthorizations.mu.Lock()
+	_, device := deviceAuthorizations.byDeviceCode[da.DeviceCode]
+	_, userCode := deviceAuthorizations.byUserCode[da.UserCode]
+	deviceAuthorizations.mu.Unlock()
+	mfaChallenges.mu.Lock()
+	_, challenge := mfaChallenges.challenges["janitor-mfa"]
+	mfaChallenges.mu.Unlock()
+	webauthnCeremonies.mu.Lock()
+	_, ceremony := webauthnCeremonies.ceremonies["janitor-ceremony"]
+	webauthnCeremonies.mu.Unlock()
+	magicLinks.mu.Lock()
+	_, token := magicLinks.tokens[link.Token]
+	_, byEmail := magicLinks.byEmail[normalizeEmail(link.Email)]
+	magicLinks.mu.Unlock()
+	_, trusted := trustedDevices.(*TrustedDeviceStore).get(hashTrustedDeviceToken("janitor-device"))
+
+	for name, left := range map[string]bool{
+		"authorization code": code,
+		"device code":        device || userCode,
+		"MFA challenge":      challenge,
+		"WebAuthn ceremony":  ceremony,
+		"magic link":         token || byEmail,
+		"trusted device":     trusted,
+	} {
+		if left {
+			t.Errorf("expired %s not evicted", name)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const accessTokenTTL = time.Hour
+
+var (
+	errInvalidToken    = errors.New("invalid token")
+	errTokenExpired    = errors.New("token expired")
+	errUnsupportedAlgo = errors.New("unsupported signing algorithm")
+)
+
+// Claims is the JWT payload carried by access tokens.
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	ID        string `json:"jti"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Act       *Actor `json:"act,omitempty"`
+}
+
+// Actor is the RFC 8693 act claim naming who is acting for the subject. A
+// nested Act records earlier links in a delegation chain.
+type Actor struct {
+	Subject string `json:"sub"`
+	Act     *Actor `json:"act,omitempty"`
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// SigningKey signs and verifies tokens with one of HS256, RS256 or ES256.
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	secret    []byte
+	private   crypto.Signer
+}
+
+func newSigningKey(algorithm string, secret []byte, private crypto.Signer) (*SigningKey, error) {
+	key := &SigningKey{Algorithm: algorithm, secret: secret, private: private}
+	switch algorithm {
+	case "HS256":
+		if len(secret) < 32 {
+			return nil, errors.New("HS256 secret must be at least 32 bytes")
+		}
+		sum := sha256.Sum256(secret)
+		key.ID = base64.RawURLEncoding.EncodeToString(sum[:12])
+		return key, nil
+	case "RS256":
+		if _, ok := private.(*rsa.PrivateKey); !ok {
+			return nil, errors.New("RS256 requires an RSA private key")
+		}
+	case "ES256":
+		ec, ok := private.(*ecdsa.PrivateKey)
+		if !ok || ec.Curve != elliptic.P256() {
+			return nil, errors.New("ES256 requires a P-256 private key")
+		}
+	default:
+		return nil, errUnsupportedAlgo
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	key.ID = base64.RawURLEncoding.EncodeToString(sum[:12])
+	return key, nil
+}
+
+// generateSigningKey creates a fresh random key for the given algorithm.
+func generateSigningKey(algorithm string) (*SigningKey, error) {
+	switch algorithm {
+	case "HS256":
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		return newSigningKey(algorithm, secret, nil)
+	case "RS256":
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return newSigningKey(algorithm, nil, private)
+	case "ES256":
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return newSigningKey(algorithm, nil, private)
+	}
+	return nil, errUnsupportedAlgo
+}
+
+// publicKey returns nil for HS256 keys, which have no public half.
+func (k *SigningKey) publicKey() crypto.PublicKey {
+	if k.private == nil {
+		return nil
+	}
+	return k.private.Public()
+}
+
+func (k *SigningKey) sign(input []byte) ([]byte, error) {
+	digest := sha256.Sum256(input)
+	switch k.Algorithm {
+	case "HS256":
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	case "RS256":
+		return rsa.SignPKCS1v15(rand.Reader, k.private.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.private.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			return nil, err
+		}
+		// JWS wants the fixed-width R || S encoding, not ASN.1
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	}
+	return nil, errUnsupportedAlgo
+}
+
+func (k *SigningKey) verify(input, sig []byte) error {
+	digest := sha256.Sum256(input)
+	switch k.Algorithm {
+	case "HS256":
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errInvalidToken
+		}
+		return nil
+	case "RS256":
+		pub := k.private.Public().(*rsa.PublicKey)
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			return errInvalidToken
+		}
+		return nil
+	case "ES256":
+		if len(sig) != 64 {
+			return errInvalidToken
+		}
+		pub := k.private.Public().(*ecdsa.PublicKey)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return errInvalidToken
+		}
+		return nil
+	}
+	return errUnsupportedAlgo
+}
+
+// JWTIssuer mints and verifies signed access tokens.
+type JWTIssuer struct {
+	issuer   string
+	audience string
+	ttl      time.Duration
+	keys     *KeyManager
+}
+
+var jwtIssuer *JWTIssuer
+
+// newJWTIssuerFromEnv builds the issuer from JWT_ALGORITHM, JWT_SECRET,
+// JWT_PRIVATE_KEY_FILE, JWT_ISSUER and JWT_AUDIENCE. The configured key is
+// only the first one; KeyManager replaces it on rotation.
+func newJWTIssuerFromEnv() (*JWTIssuer, error) {
+	algorithm := getEnv("JWT_ALGORITHM", "HS256")
+
+	var key *SigningKey
+	var err error
+	switch {
+	case algorithm == "HS256" && os.Getenv("JWT_SECRET") != "":
+		key, err = newSigningKey(algorithm, []byte(os.Getenv("JWT_SECRET")), nil)
+	case algorithm != "HS256" && os.Getenv("JWT_PRIVATE_KEY_FILE") != "":
+		var private crypto.Signer
+		private, err = loadPrivateKey(os.Getenv("JWT_PRIVATE_KEY_FILE"))
+		if err == nil {
+			key, err = newSigningKey(algorithm, nil, private)
+		}
+	default:
+		log.Printf("No %s key configured, generating an ephemeral one; tokens will not survive a restart", algorithm)
+		key, err = generateSigningKey(algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWTIssuer{
+		issuer:   getEnv("JWT_ISSUER", "http://localhost:8080"),
+		audience: getEnv("JWT_AUDIENCE", "go-auth-api"),
+		ttl:      accessTokenTTL,
+		keys:     newKeyManager(key, accessTokenTTL),
+	}, nil
+}
+
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%s: unsupported private key type", path)
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+}
+
+// NewClaims fills in the standard claims for an access token addressed to
+// this API. clientID and scope are empty for first-party logins.
+func (ji *JWTIssuer) NewClaims(subject, clientID, scope string) *Claims {
+	now := time.Now()
+	return &Claims{
+		Issuer:    ji.issuer,
+		Subject:   subject,
+		Audience:  ji.audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ji.ttl).Unix(),
+		ID:        generateID(),
+		Scope:     scope,
+		ClientID:  clientID,
+	}
+}
+
+// Sign serializes claims as a compact JWS using the active signing key.
+func (ji *JWTIssuer) Sign(claims interface{}) (string, error) {
+	key := ji.keys.Active()
+	header, err := json.Marshal(jwtHeader{
+		Algorithm: key.Algorithm,
+		Type:      "JWT",
+		KeyID:     key.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := key.sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Verify checks the token's signature, expiry, issuer and that it is
+// addressed to this API.
+func (ji *JWTIssuer) Verify(token string) (*Claims, error) {
+	claims, err := ji.VerifyAnyAudience(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Audience != ji.audience {
+		return nil, errInvalidToken
+	}
+	return claims, nil
+}
+
+// VerifyAnyAudience accepts tokens this issuer minted for other services,
+// such as the results of a token exchange.
+func (ji *JWTIssuer) VerifyAnyAudience(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errInvalidToken
+	}
+
+	key, found := ji.keys.Lookup(header.KeyID)
+	// Never let the token pick the algorithm
+	if !found || header.Algorithm != key.Algorithm {
+		return nil, errInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	if err := key.verify([]byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+
+	if claims.Issuer != ji.issuer {
+		return nil, errInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errTokenExpired
+	}
+	return &claims, nil
+}
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+func withClaims(r *http.Request, claims *Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims))
+}
+
+// claimsFromRequest returns the claims authMiddleware attached to the request.
+func claimsFromRequest(r *http.Request) (*Claims, bool) {
+	claims, ok := r.Context().Value(claimsContextKey).(*Claims)
+	return claims, ok
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
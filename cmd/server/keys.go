@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type managedKey struct {
+	key       *SigningKey
+	CreatedAt time.Time
+	RetiredAt time.Time
+}
+
+// jwksMaxAge is how long verifiers may cache the JWKS, and so the least
+// time a key is published before it signs anything.
+const jwksMaxAge = 5 * time.Minute
+
+// KeyManager holds the active signing key plus retired keys that may still
+// have unexpired tokens in circulation, and the next key, which is
+// published ahead of its use.
+type KeyManager struct {
+	mu          sync.RWMutex
+	algorithm   string
+	keys        []*managedKey
+	next        *managedKey
+	maxTokenTTL time.Duration
+}
+
+func newKeyManager(initial *SigningKey, maxTokenTTL time.Duration) *KeyManager {
+	return &KeyManager{
+		algorithm:   initial.Algorithm,
+		keys:        []*managedKey{{key: initial, CreatedAt: time.Now()}},
+		maxTokenTTL: maxTokenTTL,
+	}
+}
+
+// Active returns the key new tokens are signed with.
+func (km *KeyManager) Active() *SigningKey {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	return km.keys[0].key
+}
+
+// Lookup finds a published key by kid, active or retired.
+func (km *KeyManager) Lookup(kid string) (*SigningKey, bool) {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	for _, mk := range km.keys {
+		if mk.key.ID == kid {
+			return mk.key, true
+		}
+	}
+	return nil, false
+}
+
+// Rotate makes the next key active, retiring the current one, and publishes
+// a new next key. A next key published for less than jwksMaxAge is kept
+// waiting, since verifiers with a cached JWKS wouldn't know it yet; so is
+// the first call, which only publishes one.
+func (km *KeyManager) Rotate() error {
+	key, err := generateSigningKey(km.algorithm)
+	if err != nil {
+		return err
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case km.next == nil:
+		km.next = &managedKey{key: key, CreatedAt: now}
+	case !now.Before(km.next.CreatedAt.Add(jwksMaxAge)):
+		km.keys[0].RetiredAt = now
+		km.keys = append([]*managedKey{km.next}, km.keys...)
+		km.next = &managedKey{key: key, CreatedAt: now}
+	}
+	km.prune(now)
+	return nil
+}
+
+// prune drops retired keys once every token they signed has expired.
+func (km *KeyManager) prune(now time.Time) {
+	kept := km.keys[:1]
+	for _, mk := range km.keys[1:] {
+		if now.Before(mk.RetiredAt.Add(km.maxTokenTTL)) {
+			kept = append(kept, mk)
+		}
+	}
+	km.keys = kept
+}
+
+// Run publishes the next key straight away, then rotates keys every
+// interval until stop is closed.
+func (km *KeyManager) Run(interval time.Duration, stop <-chan struct{}) {
+	if err := km.Rotate(); err != nil {
+		log.Printf("Publishing the next signing key failed: %v", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			active := km.Active().ID
+			if err := km.Rotate(); err != nil {
+				log.Printf("Signing key rotation failed: %v", err)
+				continue
+			}
+			if km.Active().ID == active {
+				log.Printf("Next signing key not yet published for %s, keeping %s", jwksMaxAge, active)
+				continue
+			}
+			log.Printf("Rotated signing key, now %s", km.Active().ID)
+		case <-stop:
+			return
+		}
+	}
+}
+
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWKS returns the public halves of every published key, including the
+// next one. HS256 secrets are never published.
+func (km *KeyManager) JWKS() []JWK {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	published := km.keys
+	if km.next != nil {
+		published = append([]*managedKey{km.next}, km.keys...)
+	}
+
+	jwks := []JWK{}
+	for _, mk := range published {
+		if !mk.RetiredAt.IsZero() && time.Now().After(mk.RetiredAt.Add(km.maxTokenTTL)) {
+			continue
+		}
+
+		k := mk.key
+		switch pub := k.publicKey().(type) {
+		case *rsa.PublicKey:
+			jwks = append(jwks, JWK{
+				KeyType:   "RSA",
+				KeyID:     k.ID,
+				Use:       "sig",
+				Algorithm: k.Algorithm,
+				N:         base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			x := make([]byte, 32)
+			y := make([]byte, 32)
+			pub.X.FillBytes(x)
+			pub.Y.FillBytes(y)
+			jwks = append(jwks, JWK{
+				KeyType:   "EC",
+				KeyID:     k.ID,
+				Use:       "sig",
+				Algorithm: k.Algorithm,
+				Curve:     "P-256",
+				X:         base64.RawURLEncoding.EncodeToString(x),
+				Y:         base64.RawURLEncoding.EncodeToString(y),
+			})
+		}
+	}
+	return jwks
+}
+
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": jwtIssuer.keys.JWKS(),
+	})
+}
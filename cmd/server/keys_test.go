@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRotatePublishesNextKeyBeforeSigning(t *testing.T) {
+	initial, err := generateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	km := newKeyManager(initial, time.Hour)
+
+	// The first rotation only publishes the next key
+	if err := km.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if km.Active().ID != initial.ID {
+		t.Fatal("next key signs before it was published")
+	}
+	if len(km.JWKS()) != 2 {
+		t.Fatalf("JWKS lists %d keys, want the active and next keys", len(km.JWKS()))
+	}
+	next := km.next.key.ID
+
+	// Too soon for a verifier's cached JWKS to include it
+	if err := km.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if km.Active().ID != initial.ID || km.next.key.ID != next {
+		t.Fatal("next key promoted within the JWKS cache lifetime")
+	}
+
+	km.next.CreatedAt = time.Now().Add(-jwksMaxAge)
+	if err := km.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if km.Active().ID != next {
+		t.Fatal("next key not promoted once published for jwksMaxAge")
+	}
+	if _, ok := km.Lookup(initial.ID); !ok {
+		t.Error("retired key no longer verifies its tokens")
+	}
+	if len(km.JWKS()) != 3 {
+		t.Errorf("JWKS lists %d keys, want next, active and retired", len(km.JWKS()))
+	}
+}
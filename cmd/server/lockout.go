@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// loginThrottledError refuses a password attempt without checking it,
+// because the account has failed too often recently.
+type loginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *loginThrottledError) Error() string {
+	return "too many failed sign-in attempts"
+}
+
+// After loginBackoffAfter consecutive failures each further attempt must
+// wait, starting at loginBackoffBase and doubling up to loginBackoffMax.
+const (
+	loginBackoffAfter = 3
+	loginBackoffBase  = time.Second
+	loginBackoffMax   = time.Minute
+)
+
+// loginLockout locks an account for Duration once it reaches Threshold
+// consecutive failures. Set from LOGIN_LOCKOUT_THRESHOLD and
+// LOGIN_LOCKOUT_DURATION.
+var loginLockout = struct {
+	Threshold int
+	Duration  time.Duration
+}{
+	Threshold: 10,
+	Duration:  15 * time.Minute,
+}
+
+func loadLoginLockoutFromEnv() error {
+	threshold, err := strconv.Atoi(getEnv("LOGIN_LOCKOUT_THRESHOLD", "10"))
+	if err != nil || threshold < 1 {
+		return fmt.Errorf("invalid LOGIN_LOCKOUT_THRESHOLD %q", getEnv("LOGIN_LOCKOUT_THRESHOLD", "10"))
+	}
+	duration, err := time.ParseDuration(getEnv("LOGIN_LOCKOUT_DURATION", "15m"))
+	if err != nil || duration <= 0 {
+		return fmt.Errorf("invalid LOGIN_LOCKOUT_DURATION %q", getEnv("LOGIN_LOCKOUT_DURATION", "15m"))
+	}
+	loginLockout.Threshold = threshold
+	loginLockout.Duration = duration
+	return nil
+}
+
+// loginFailures tracks one email address. Unknown addresses are tracked
+// the same way, so how the API answers never reveals whether an account
+// exists.
+type loginFailures struct {
+	Count       int
+	LastFailure time.Time
+	NotBefore   time.Time
+	Locked      bool
+	UnlockToken string
+	// InFlight counts attempts let through whose password is still being
+	// checked; each may yet turn out to be a failure
+	InFlight int
+}
+
+var loginAttempts = struct {
+	mu           sync.Mutex
+	byEmail      map[string]*loginFailures
+	unlockTokens map[string]string // token -> normalized email
+	// bySecondFactor counts wrong second factor codes per user ID, apart
+	// from passwords: a correct password must not reset them
+	bySecondFactor map[string]*loginFailures
+}{
+	byEmail:        make(map[string]*loginFailures),
+	unlockTokens:   make(map[string]string),
+	bySecondFactor: make(map[string]*loginFailures),
+}
+
+// dummyPasswordHash is compared against for unknown accounts, so they take
+// as long to reject as a wrong password.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte(generateToken()), bcrypt.DefaultCost)
+	return hash
+})
+
+// checkLoginAllowed reports whether email may try a password now, and if
+// so reserves the attempt. The caller must settle it with
+// recordLoginFailure or clearLoginFailures.
+//
+// Checking a password takes a while, so attempts are counted as failures
+// until they settle: once the ones in flight could bring the account to
+// backoff, further attempts wait for them instead of all slipping through.
+func checkLoginAllowed(email string, now time.Time) error {
+	loginAttempts.mu.Lock()
+	defer loginAttempts.mu.Unlock()
+	return reserveAttempt(loginAttempts.byEmail, normalizeEmail(email), now)
+}
+
+// reserveAttempt applies checkLoginAllowed to the failures recorded under
+// key. loginAttempts.mu must be held.
+func reserveAttempt(failures map[string]*loginFailures, key string, now time.Time) error {
+	f := failureRecord(failures, key)
+	if now.Before(f.NotBefore) {
+		return &loginThrottledError{RetryAfter: f.NotBefore.Sub(now)}
+	}
+	limit := loginBackoffAfter
+	if loginLockout.Threshold < limit {
+		limit = loginLockout.Threshold
+	}
+	if f.InFlight > 0 && f.Count+f.InFlight >= limit {
+		return &loginThrottledError{RetryAfter: loginBackoffBase}
+	}
+	f.InFlight++
+	return nil
+}
+
+func failureRecord(failures map[string]*loginFailures, key string) *loginFailures {
+	f, exists := failures[key]
+	if !exists {
+		f = &loginFailures{}
+		failures[key] = f
+	}
+	return f
+}
+
+// recordLoginFailure counts a wrong password for email, which belongs to
+// user if the account exists, and applies backoff or the lockout.
+func recordLoginFailure(r *http.Request, email string, user *User) {
+	now := time.Now()
+	key := normalizeEmail(email)
+
+	loginAttempts.mu.Lock()
+	f := failureRecord(loginAttempts.byEmail, key)
+	locked := countFailure(f, now)
+	if locked && user != nil {
+		f.UnlockToken = generateToken()
+		loginAttempts.unlockTokens[f.UnlockToken] = key
+	}
+	failures, unlockToken := f.Count, f.UnlockToken
+	loginAttempts.mu.Unlock()
+
+	if !locked {
+		return
+	}
+	userID := ""
+	if user != nil {
+		userID = user.ID
+	}
+	auditLogger.Log(userID, "account_locked", "user", r.RemoteAddr, map[string]interface{}{
+		"email":    key,
+		"failures": failures,
+		"until":    now.Add(loginLockout.Duration),
+	})
+	if user != nil {
+		sendUnlockEmail(user, unlockToken)
+	}
+}
+
+// countFailure settles a reserved attempt as a failure and applies backoff
+// or the lockout. It reports whether the failure locked the account.
+// loginAttempts.mu must be held.
+func countFailure(f *loginFailures, now time.Time) bool {
+	if f.InFlight > 0 {
+		f.InFlight--
+	}
+	// Failures are consecutive ones; a lockout that ran out, or a long
+	// enough pause, starts the count over
+	if (f.Locked && !now.Before(f.NotBefore)) || now.Sub(f.LastFailure) > loginLockout.Duration {
+		delete(loginAttempts.unlockTokens, f.UnlockToken)
+		*f = loginFailures{InFlight: f.InFlight}
+	}
+	f.Count++
+	f.LastFailure = now
+
+	locked := false
+	if f.Count >= loginLockout.Threshold {
+		locked = !f.Locked
+		f.Locked = true
+		f.NotBefore = now.Add(loginLockout.Duration)
+	} else if f.Count >= loginBackoffAfter {
+		delay := loginBackoffMax
+		if shift := f.Count - loginBackoffAfter; shift < 16 && loginBackoffBase<<shift < delay {
+			delay = loginBackoffBase << shift
+		}
+		f.NotBefore = now.Add(delay)
+	}
+	return locked
+}
+
+// clearLoginFailures forgets the failures of email and lifts any lockout,
+// settling a successful attempt. It reports whether the account was locked.
+func clearLoginFailures(email string) bool {
+	loginAttempts.mu.Lock()
+	defer loginAttempts.mu.Unlock()
+
+	key := normalizeEmail(email)
+	f, exists := loginAttempts.byEmail[key]
+	if !exists {
+		return false
+	}
+	delete(loginAttempts.unlockTokens, f.UnlockToken)
+	delete(loginAttempts.byEmail, key)
+	return f.Locked && time.Now().Before(f.NotBefore)
+}
+
+// checkSecondFactorAllowed is checkLoginAllowed for second factor codes.
+// The caller must settle the attempt with recordSecondFactorFailure or
+// clearSecondFactorFailures.
+func checkSecondFactorAllowed(userID string, now time.Time) error {
+	loginAttempts.mu.Lock()
+	defer loginAttempts.mu.Unlock()
+	return reserveAttempt(loginAttempts.bySecondFactor, userID, now)
+}
+
+// recordSecondFactorFailure counts a wrong second factor code for the user.
+// The lockout only runs out or is lifted by an admin; the unlock email is
+// for password lockouts, and whoever is guessing codes knows the password.
+func recordSecondFactorFailure(r *http.Request, userID string) {
+	now := time.Now()
+
+	loginAttempts.mu.Lock()
+	f := failureRecord(loginAttempts.bySecondFactor, userID)
+	locked := countFailure(f, now)
+	failures := f.Count
+	loginAttempts.mu.Unlock()
+
+	if locked {
+		auditLogger.Log(userID, "account_locked", "mfa", r.RemoteAddr, map[string]interface{}{
+			"failures": failures,
+			"until":    now.Add(loginLockout.Duration),
+		})
+	}
+}
+
+// clearSecondFactorFailures forgets the user's wrong codes and lifts any
+// lockout. It reports whether the second factor was locked.
+func clearSecondFactorFailures(userID string) bool {
+	loginAttempts.mu.Lock()
+	defer loginAttempts.mu.Unlock()
+
+	f, exists := loginAttempts.bySecondFactor[userID]
+	if !exists {
+		return false
+	}
+	delete(loginAttempts.bySecondFactor, userID)
+	return f.Locked && time.Now().Before(f.NotBefore)
+}
+
+// deleteStaleLoginFailures drops records that no longer affect anything:
+// not locked or backing off, and too old to count towards a lockout.
+func deleteStaleLoginFailures(now time.Time) int {
+	loginAttempts.mu.Lock()
+	defer loginAttempts.mu.Unlock()
+
+	n := 0
+	for _, failures := range []map[string]*loginFailures{loginAttempts.byEmail, loginAttempts.bySecondFactor} {
+		for key, f := range failures {
+			if f.InFlight == 0 && !now.Before(f.NotBefore) && now.Sub(f.LastFailure) > loginLockout.Duration {
+				delete(loginAttempts.unlockTokens, f.UnlockToken)
+				delete(failures, key)
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func sendUnlockEmail(user *User, token string) {
+	linkURL := getEnv("UNLOCK_URL", jwtIssuer.issuer+"/unlock-account") + "?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Sign-in to your account was locked after %d failed password attempts.\n\n"+
+		"If this was you, unlock it now:\n\n%s\n\n"+
+		"Otherwise it unlocks itself in %d minutes. If you didn't make these attempts, consider changing your password.",
+		loginLockout.Threshold, linkURL, int(loginLockout.Duration.Minutes()))
+
+	go func() {
+		if err := mailer.Send(user.Email, "Your account has been locked", body); err != nil {
+			log.Printf("Failed to send unlock email: %v", err)
+		}
+	}()
+}
+
+// writeLoginError answers a failed password sign-in. Locked and unknown
+// accounts are indistinguishable from the outside.
+func writeLoginError(w http.ResponseWriter, err error) {
+	var throttled *loginThrottledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", ceilSeconds(throttled.RetryAfter))
+		http.Error(w, "Too many failed sign-in attempts; try again later", http.StatusTooManyRequests)
+		return
+	}
+	http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+}
+
+// loginFormError is the message the HTML sign-in pages show instead.
+func loginFormError(err error) string {
+	var throttled *loginThrottledError
+	if errors.As(err, &throttled) {
+		return "Too many failed sign-in attempts. Try again later"
+	}
+	return "Invalid email or password"
+}
+
+// redeemUnlockToken lifts the lockout the token was sent for. It reports
+// false if the token is unknown. A lockout that already ran out still
+// counts as unlocked: the link's owner can sign in either way.
+func redeemUnlockToken(r *http.Request, token string) bool {
+	loginAttempts.mu.Lock()
+	email, exists := loginAttempts.unlockTokens[token]
+	loginAttempts.mu.Unlock()
+	if token == "" || !exists {
+		return false
+	}
+	wasLocked := clearLoginFailures(email)
+
+	userID := ""
+	if user, exists := store.GetByEmail(email); exists {
+		userID = user.ID
+	}
+	auditLogger.Log(userID, "account_unlocked", "user", r.RemoteAddr, map[string]interface{}{
+		"method":     "email",
+		"was_locked": wasLocked,
+	})
+	return true
+}
+
+// unlockAccountHandler redeems the link from the lockout email.
+func unlockAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !redeemUnlockToken(r, req.Token) {
+		http.Error(w, "Invalid or expired unlock link", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Account unlocked",
+	})
+}
+
+var unlockAccountPage = template.Must(template.New("unlock").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Unlock your account</title></head>
+<body>
+<h1>Unlock your account</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if not .Done}}
+<form method="POST" action="/unlock-account">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Unlock</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// unlockAccountPageHandler is where the lockout email links to by default.
+// Opening the link only shows a button, so mail scanners that follow links
+// don't unlock the account.
+func unlockAccountPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page := struct {
+		Token   string
+		Message string
+		Done    bool
+	}{
+		Token: r.URL.Query().Get("token"),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	if r.Method == http.MethodPost {
+		page.Done = true
+		if redeemUnlockToken(r, r.PostFormValue("token")) {
+			page.Message = "Your account is unlocked. You can sign in again."
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+			page.Message = "This unlock link is invalid or has expired."
+		}
+	}
+	unlockAccountPage.Execute(w, page)
+}
+
+// adminUnlockAccountHandler lifts a lockout and clears the failure counts,
+// for passwords and second factor codes, for an email address.
+func adminUnlockAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	wasLocked := clearLoginFailures(req.Email)
+
+	userID := ""
+	if user, exists := store.GetByEmail(req.Email); exists {
+		userID = user.ID
+		// Also lifts a lockout from wrong second factor codes
+		if clearSecondFactorFailures(user.ID) {
+			wasLocked = true
+		}
+	}
+	auditLogger.Log(userID, "account_unlocked", "user", r.RemoteAddr, map[string]interface{}{
+		"method":     "admin",
+		"email":      normalizeEmail(req.Email),
+		"was_locked": wasLocked,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"email":      normalizeEmail(req.Email),
+		"was_locked": wasLocked,
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckLoginAllowedReservesAttempts(t *testing.T) {
+	email := "concurrent@example.com"
+	t.Cleanup(func() { clearLoginFailures(email) })
+	now := time.Now()
+
+	// Attempts in flight count as failures until settled, so no more than
+	// enough to reach backoff are let through at once
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if checkLoginAllowed(email, now) == nil {
+			allowed++
+		}
+	}
+	if allowed != loginBackoffAfter {
+		t.Fatalf("%d parallel attempts allowed, want %d", allowed, loginBackoffAfter)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+	for i := 0; i < allowed; i++ {
+		recordLoginFailure(r, email, nil)
+	}
+	if err := checkLoginAllowed(email, time.Now()); err == nil {
+		t.Fatal("attempt allowed during backoff")
+	}
+	if err := checkLoginAllowed(email, time.Now().Add(loginBackoffBase)); err != nil {
+		t.Fatalf("attempt refused after backoff: %v", err)
+	}
+	if err := checkLoginAllowed(email, time.Now().Add(loginBackoffBase)); err == nil {
+		t.Fatal("second attempt allowed while the first is in flight")
+	}
+}
+
+func TestUnlockAccountPage(t *testing.T) {
+	email := "unlock-page@example.com"
+	token := "unlock-page-token"
+	loginAttempts.mu.Lock()
+	loginAttempts.byEmail[email] = &loginFailures{
+		Count:       loginLockout.Threshold,
+		NotBefore:   time.Now().Add(time.Hour),
+		Locked:      true,
+		UnlockToken: token,
+	}
+	loginAttempts.unlockTokens[token] = email
+	loginAttempts.mu.Unlock()
+	t.Cleanup(func() { clearLoginFailures(email) })
+
+	// Opening the link must not unlock by itself
+	w := httptest.NewRecorder()
+	unlockAccountPageHandler(w, httptest.NewRequest(http.MethodGet, "/unlock-account?token="+token, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), token) {
+		t.Fatalf("GET: got %d %q", w.Code, w.Body.String())
+	}
+	if err := checkLoginAllowed(email, time.Now()); err == nil {
+		t.Fatal("account unlocked by GET")
+	}
+
+	form := url.Values{"token": {token}}
+	for _, want := range []int{http.StatusOK, http.StatusBadRequest} {
+		r := httptest.NewRequest(http.MethodPost, "/unlock-account", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		unlockAccountPageHandler(w, r)
+		if w.Code != want {
+			t.Errorf("POST: got %d, want %d", w.Code, want)
+		}
+	}
+	if err := checkLoginAllowed(email, time.Now()); err != nil {
+		t.Errorf("still locked after unlocking: %v", err)
+	}
+}
+
+func TestUnlockLinkAfterLockoutExpired(t *testing.T) {
+	email := "unlock-expired@example.com"
+	token := "unlock-expired-token"
+	loginAttempts.mu.Lock()
+	loginAttempts.byEmail[email] = &loginFailures{
+		Count:       loginLockout.Threshold,
+		NotBefore:   time.Now().Add(-time.Minute),
+		Locked:      true,
+		UnlockToken: token,
+	}
+	loginAttempts.unlockTokens[token] = email
+	loginAttempts.mu.Unlock()
+	t.Cleanup(func() { clearLoginFailures(email) })
+
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/unlock", nil)
+	if !redeemUnlockToken(r, token) {
+		t.Fatal("link for an expired lockout reported as invalid")
+	}
+	if redeemUnlockToken(r, token) {
+		t.Error("unlock link redeemed twice")
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"net/http"
-	"strings"
 )
 
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
@@ -12,16 +11,14 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Authorization header required", http.StatusUnauthorized)
-		return
+	// Delete session, along with the rest of its sign-in
+	if session, ok := sessionFromRequest(r); ok {
+		sessionStore.Delete(session.Token)
+		if session.UserID != "" {
+			revokeSession(session.UserID, session.ID)
+		}
 	}
-
-	token := strings.TrimPrefix(authHeader, "Bearer ")
-
-	// Delete session
-	sessionStore.Delete(token)
+	clearSessionCookies(w)
 
 	// Revoke refresh token if provided
 	var req struct {
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	magicLinkTTL         = 15 * time.Minute
+	magicLinkMaxAttempts = 5
+)
+
+// MagicLink is a single-use sign-in sent by email, redeemable either by the
+// token in the link or by the 6-digit code with the email address.
+type MagicLink struct {
+	Token     string
+	Code      string
+	UserID    string
+	Email     string
+	Attempts  int
+	ExpiresAt time.Time
+}
+
+// magicLinks keeps one outstanding link per email; requesting another
+// replaces it.
+var magicLinks = &struct {
+	mu      sync.Mutex
+	tokens  map[string]*MagicLink
+	byEmail map[string]*MagicLink
+}{
+	tokens:  make(map[string]*MagicLink),
+	byEmail: make(map[string]*MagicLink),
+}
+
+// deleteExpiredMagicLinks drops links that were never redeemed.
+func deleteExpiredMagicLinks(now time.Time) int {
+	magicLinks.mu.Lock()
+	defer magicLinks.mu.Unlock()
+
+	n := 0
+	for token, link := range magicLinks.tokens {
+		if now.After(link.ExpiresAt) {
+			delete(magicLinks.tokens, token)
+			if magicLinks.byEmail[normalizeEmail(link.Email)] == link {
+				delete(magicLinks.byEmail, normalizeEmail(link.Email))
+			}
+			n++
+		}
+	}
+	return n
+}
+
+func magicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, exists := store.GetByEmail(req.Email)
+
+	if exists {
+		sendMagicLink(user)
+	}
+
+	// Same answer whether or not the account exists
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If the email exists, a sign-in link has been sent",
+	})
+}
+
+func sendMagicLink(user *User) {
+	link, err := generateMagicLink(user)
+	if err != nil {
+		log.Printf("Failed to create magic link: %v", err)
+		return
+	}
+
+	// Links must point at the application's own page, which posts the token
+	// to /api/auth/magic-link/verify; without one only the code is sent
+	subject := "Your sign-in code"
+	body := fmt.Sprintf("Enter this code to sign in: %s\n\nIt expires in %d minutes.",
+		link.Code, int(magicLinkTTL.Minutes()))
+	if pageURL := getEnv("MAGIC_LINK_URL", ""); pageURL != "" {
+		linkURL := pageURL + "?token=" + url.QueryEscape(link.Token)
+		subject = "Your sign-in link"
+		body = fmt.Sprintf("Sign in with this link:\n\n%s\n\nOr enter this code: %s\n\nThe link and code expire in %d minutes.",
+			linkURL, link.Code, int(magicLinkTTL.Minutes()))
+	}
+
+	// Sent in the background so response time doesn't reveal the account
+	go func() {
+		if err := mailer.Send(user.Email, subject, body); err != nil {
+			log.Printf("Failed to send magic link: %v", err)
+		}
+	}()
+}
+
+func generateMagicLink(user *User) (*MagicLink, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return nil, err
+	}
+	link := &MagicLink{
+		Token:     generateToken(),
+		Code:      fmt.Sprintf("%06d", n.Int64()),
+		UserID:    user.ID,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(magicLinkTTL),
+	}
+
+	magicLinks.mu.Lock()
+	if previous, exists := magicLinks.byEmail[normalizeEmail(user.Email)]; exists {
+		delete(magicLinks.tokens, previous.Token)
+	}
+	magicLinks.tokens[link.Token] = link
+	magicLinks.byEmail[normalizeEmail(user.Email)] = link
+	magicLinks.mu.Unlock()
+	return link, nil
+}
+
+// redeemMagicLink consumes a link by token, or by email and code. A code
+// guessed wrong too many times invalidates the link.
+func redeemMagicLink(token, email, code string) (*MagicLink, bool) {
+	magicLinks.mu.Lock()
+	defer magicLinks.mu.Unlock()
+
+	var link *MagicLink
+	if token != "" {
+		link = magicLinks.tokens[token]
+	} else if email != "" && code != "" {
+		link = magicLinks.byEmail[normalizeEmail(email)]
+		if link != nil && subtle.ConstantTimeCompare([]byte(link.Code), []byte(code)) != 1 {
+			link.Attempts++
+			if link.Attempts >= magicLinkMaxAttempts {
+				delete(magicLinks.tokens, link.Token)
+				delete(magicLinks.byEmail, normalizeEmail(link.Email))
+			}
+			return nil, false
+		}
+	}
+	if link == nil {
+		return nil, false
+	}
+
+	delete(magicLinks.tokens, link.Token)
+	delete(magicLinks.byEmail, normalizeEmail(link.Email))
+	if time.Now().After(link.ExpiresAt) {
+		return nil, false
+	}
+	return link, true
+}
+
+func redeemMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Token              string `json:"token"`
+		Email              string `json:"email"`
+		Code               string `json:"code"`
+		TrustedDeviceToken string `json:"trusted_device_token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	link, ok := redeemMagicLink(req.Token, req.Email, req.Code)
+	if !ok {
+		http.Error(w, "Invalid or expired sign-in link", http.StatusUnauthorized)
+		return
+	}
+
+	// Receiving the email proves the address
+	if user, exists := store.GetByID(link.UserID); exists && normalizeEmail(user.Email) == normalizeEmail(link.Email) && !user.EmailVerified {
+		user.EmailVerified = true
+		store.Update(user)
+	}
+
+	auditLogger.Log(link.UserID, "magic_link_login", "session", r.RemoteAddr, nil)
+
+	// The link replaces the password, not the second factor
+	if requiresMFA(r, link.UserID, req.TrustedDeviceToken) {
+		writeMFAChallenge(w, link.UserID, []string{"email"})
+		return
+	}
+
+	token, err := issueTokens(r, Grant{
+		UserID:   link.UserID,
+		AuthTime: time.Now(),
+		AMR:      []string{"email"},
+	})
+	if err != nil {
+		writeIssueTokenError(w, err)
+		return
+	}
+
+	writeSignInResponse(w, token, "", wantsCookieTransport(r))
+}
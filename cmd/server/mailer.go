@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// Mailer delivers transactional email such as login links.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// logMailer writes messages to the server log, for development.
+type logMailer struct{}
+
+func (logMailer) Send(to, subject, body string) error {
+	log.Printf("Email to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	// Refuse header injection through the recipient or subject
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+	msg := "From: " + m.from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
+
+var mailer Mailer = logMailer{}
+
+// newMailerFromEnv sends through SMTP_ADDR when it is set and logs
+// otherwise.
+func newMailerFromEnv() Mailer {
+	addr := getEnv("SMTP_ADDR", "")
+	if addr == "" {
+		return logMailer{}
+	}
+	m := &smtpMailer{
+		addr: addr,
+		from: getEnv("SMTP_FROM", "no-reply@localhost"),
+	}
+	if username := getEnv("SMTP_USERNAME", ""); username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", username, getEnv("SMTP_PASSWORD", ""), host)
+	}
+	return m
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"sync"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -18,39 +22,143 @@ type User struct {
 	Email     string    `json:"email"`
 	PasswordHash string `json:"-"`
 	Name      string    `json:"name"`
+	EmailVerified bool  `json:"email_verified"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
 type Token struct {
 	AccessToken  string    `json:"access_token"`
-	RefreshToken string    `json:"refresh_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
 	TokenType    string    `json:"token_type"`
 	ExpiresIn    int       `json:"expires_in"`
+	Scope        string    `json:"scope,omitempty"`
+	IDToken      string    `json:"id_token,omitempty"`
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
 }
 
-type UserStore struct {
-	mu    sync.RWMutex
-	users map[string]*User
-}
+func main() {
+	issuer, err := newJWTIssuerFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure JWT issuer: %v", err)
+	}
+	jwtIssuer = issuer
+	if !oidcEnabled() {
+		log.Printf("OpenID Connect is disabled: ID tokens need JWT_ALGORITHM=RS256 or ES256")
+	}
 
-var store = &UserStore{
-	users: make(map[string]*User),
-}
+	if err := configureStorage(); err != nil {
+		log.Fatalf("Failed to configure storage: %v", err)
+	}
+	relyingParty = newRelyingPartyFromEnv()
+	mailer = newMailerFromEnv()
 
-func main() {
-	http.HandleFunc("/api/auth/register", loggingMiddleware(rateLimitMiddleware(registerHandler)))
-	http.HandleFunc("/api/auth/login", loggingMiddleware(rateLimitMiddleware(loginHandler)))
+	if err := loadClientsFromEnv(); err != nil {
+		log.Fatalf("Failed to load OAuth clients: %v", err)
+	}
+
+	rotationInterval, err := time.ParseDuration(getEnv("JWT_KEY_ROTATION_INTERVAL", "24h"))
+	if err != nil {
+		log.Fatalf("Invalid JWT_KEY_ROTATION_INTERVAL: %v", err)
+	}
+	stop := make(chan struct{})
+	if rotationInterval > 0 {
+		go jwtIssuer.keys.Run(rotationInterval, stop)
+	}
+
+	stepUpMaxAge, err = time.ParseDuration(getEnv("STEP_UP_MAX_AGE", "10m"))
+	if err != nil {
+		log.Fatalf("Invalid STEP_UP_MAX_AGE: %v", err)
+	}
+	trustedDeviceTTL, err = time.ParseDuration(getEnv("TRUSTED_DEVICE_TTL", "720h"))
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_DEVICE_TTL: %v", err)
+	}
+	if err := loadSessionPoliciesFromEnv(); err != nil {
+		log.Fatalf("Failed to configure session policies: %v", err)
+	}
+	if err := loadCookieConfigFromEnv(); err != nil {
+		log.Fatalf("Failed to configure cookies: %v", err)
+	}
+	if err := loadLoginLockoutFromEnv(); err != nil {
+		log.Fatalf("Failed to configure login lockout: %v", err)
+	}
+	if err := loadSessionLimitFromEnv(); err != nil {
+		log.Fatalf("Failed to configure session limit: %v", err)
+	}
+	janitorInterval, err = time.ParseDuration(getEnv("JANITOR_INTERVAL", "1m"))
+	if err != nil || janitorInterval <= 0 {
+		log.Fatalf("Invalid JANITOR_INTERVAL: %q", getEnv("JANITOR_INTERVAL", "1m"))
+	}
+	janitorDone := make(chan struct{})
+	go runJanitor(janitorInterval, stop, janitorDone)
+
+	http.HandleFunc("/api/auth/register", loggingMiddleware(rateLimitMiddleware(registerRateLimit, registerHandler)))
+	http.HandleFunc("/api/auth/login", loggingMiddleware(rateLimitMiddleware(authRateLimit, loginHandler)))
 	http.HandleFunc("/api/auth/refresh", loggingMiddleware(refreshTokenHandler))
-	http.HandleFunc("/api/auth/forgot-password", loggingMiddleware(rateLimitMiddleware(forgotPasswordHandler)))
-	http.HandleFunc("/api/auth/reset-password", loggingMiddleware(rateLimitMiddleware(resetPasswordHandler)))
+	http.HandleFunc("/api/auth/forgot-password", loggingMiddleware(rateLimitMiddleware(emailRateLimit, forgotPasswordHandler)))
+	http.HandleFunc("/api/auth/reset-password", loggingMiddleware(rateLimitMiddleware(authRateLimit, resetPasswordHandler)))
 	http.HandleFunc("/api/auth/verify-email", loggingMiddleware(verifyEmailHandler))
+	http.HandleFunc("/api/auth/mfa/verify", loggingMiddleware(rateLimitMiddleware(authRateLimit, verifyMFAHandler)))
+	http.HandleFunc("/api/auth/mfa/totp/enroll", loggingMiddleware(authMiddleware(enrollTOTPHandler)))
+	http.HandleFunc("/api/auth/mfa/totp/confirm", loggingMiddleware(authMiddleware(confirmTOTPHandler)))
+	http.HandleFunc("/api/auth/mfa/totp/disable", loggingMiddleware(authMiddleware(stepUpMiddleware(disableTOTPHandler))))
+	http.HandleFunc("/api/auth/webauthn/register/begin", loggingMiddleware(authMiddleware(stepUpMiddleware(beginPasskeyRegistrationHandler))))
+	http.HandleFunc("/api/auth/webauthn/register/finish", loggingMiddleware(authMiddleware(stepUpMiddleware(finishPasskeyRegistrationHandler))))
+	http.HandleFunc("/api/auth/webauthn/login/begin", loggingMiddleware(rateLimitMiddleware(authRateLimit, beginPasskeyLoginHandler)))
+	http.HandleFunc("/api/auth/webauthn/login/finish", loggingMiddleware(rateLimitMiddleware(authRateLimit, finishPasskeyLoginHandler)))
+	http.HandleFunc("/api/auth/webauthn/credentials", loggingMiddleware(authMiddleware(passkeysHandler)))
+	http.HandleFunc("/api/auth/magic-link", loggingMiddleware(rateLimitMiddleware(emailRateLimit, magicLinkHandler)))
+	http.HandleFunc("/api/auth/unlock", loggingMiddleware(rateLimitMiddleware(authRateLimit, unlockAccountHandler)))
+	http.HandleFunc("/unlock-account", loggingMiddleware(rateLimitMiddleware(pageRateLimit, unlockAccountPageHandler)))
+	http.HandleFunc("/api/auth/magic-link/verify", loggingMiddleware(rateLimitMiddleware(authRateLimit, redeemMagicLinkHandler)))
 	http.HandleFunc("/api/auth/logout", loggingMiddleware(authMiddleware(logoutHandler)))
 	http.HandleFunc("/api/users/me", loggingMiddleware(authMiddleware(meHandler)))
+	http.HandleFunc("/api/users/me/sessions", loggingMiddleware(authMiddleware(userSessionsHandler)))
+	http.HandleFunc("/api/users/me/sessions/", loggingMiddleware(authMiddleware(userSessionsHandler)))
+	http.HandleFunc("/api/users/me/trusted-devices", loggingMiddleware(authMiddleware(trustedDevicesHandler)))
+	http.HandleFunc("/api/users/me/trusted-devices/", loggingMiddleware(authMiddleware(trustedDevicesHandler)))
 	http.HandleFunc("/api/users/profile", loggingMiddleware(authMiddleware(updateProfileHandler)))
+	http.HandleFunc("/api/oauth/introspect", loggingMiddleware(introspectHandler))
+	http.HandleFunc("/api/oauth/revoke", loggingMiddleware(revokeHandler))
+	http.HandleFunc("/oauth/authorize", loggingMiddleware(rateLimitMiddleware(pageRateLimit, authorizeHandler)))
+	http.HandleFunc("/oauth/token", loggingMiddleware(tokenHandler))
+	http.HandleFunc("/oauth/device_authorization", loggingMiddleware(rateLimitMiddleware(authRateLimit, deviceAuthorizationHandler)))
+	http.HandleFunc("/oauth/device", loggingMiddleware(rateLimitMiddleware(pageRateLimit, deviceVerificationHandler)))
+	http.HandleFunc("/api/admin/clients", loggingMiddleware(adminMiddleware(createClientHandler)))
+	http.HandleFunc("/api/admin/clients/rotate-secret", loggingMiddleware(adminMiddleware(rotateClientSecretHandler)))
+	http.HandleFunc("/api/admin/clients/disable", loggingMiddleware(adminMiddleware(disableClientHandler)))
+	http.HandleFunc("/api/admin/users/unlock", loggingMiddleware(adminMiddleware(adminUnlockAccountHandler)))
+	http.HandleFunc("/api/admin/metrics", loggingMiddleware(adminMiddleware(metricsHandler)))
 	http.HandleFunc("/health", healthHandler)
+	http.HandleFunc("/.well-known/jwks.json", jwksHandler)
+	http.HandleFunc("/.well-known/openid-configuration", discoveryHandler)
+	http.HandleFunc("/userinfo", loggingMiddleware(authMiddleware(userInfoHandler)))
 
+	server := &http.Server{Addr: ":8080"}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 	fmt.Println("Go Auth API running on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+
+	// On SIGINT/SIGTERM let in-flight requests finish, stop background
+	// work, then flush storage
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
+	}
+	close(stop)
+	<-janitorDone
+	if err := closeStorage(); err != nil {
+		log.Printf("Failed to close storage: %v", err)
+	}
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -77,6 +185,7 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	req.Email = strings.TrimSpace(req.Email)
 
 	if !validateEmail(req.Email) {
 		http.Error(w, "Invalid email format", http.StatusBadRequest)
@@ -88,9 +197,7 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	store.mu.Lock()
-	if _, exists := store.users[req.Email]; exists {
-		store.mu.Unlock()
+	if _, exists := store.GetByEmail(req.Email); exists {
 		http.Error(w, "User already exists", http.StatusConflict)
 		return
 	}
@@ -104,11 +211,20 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		Name:        req.Name,
 		CreatedAt:    time.Now(),
 	}
-	store.users[req.Email] = user
+	if err := store.Create(user); err == errUserExists {
+		http.Error(w, "User already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
 	
 	// Generate verification token
-	verificationToken := generateVerificationToken(req.Email, user.ID)
-	store.mu.Unlock()
+	verificationToken, err := generateVerificationToken(req.Email, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to create verification token", http.StatusInternalServerError)
+		return
+	}
 
 	// In production, send verification email
 	w.Header().Set("Content-Type", "application/json")
@@ -132,8 +248,9 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email              string `json:"email"`
+		Password           string `json:"password"`
+		TrustedDeviceToken string `json:"trusted_device_token"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -141,66 +258,62 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	store.mu.RLock()
-	user, exists := store.users[req.Email]
-	store.mu.RUnlock()
-
-	if !exists {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	user, err := authenticateUser(r, req.Email, req.Password)
+	if err != nil {
+		writeLoginError(w, err)
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	// With two-factor enabled the password only earns a challenge, unless
+	// this browser was remembered; tokens come from /api/auth/mfa/verify
+	if requiresMFA(r, user.ID, req.TrustedDeviceToken) {
+		writeMFAChallenge(w, user.ID, []string{"pwd"})
 		return
 	}
 
-	accessToken := generateToken()
-	refreshToken := generateToken()
-	
-	// Store refresh token
-	refreshTokens.Store(refreshToken, user.ID, 7*24*time.Hour)
-	
-	// Create session
-	ip := r.RemoteAddr
-	userAgent := r.UserAgent()
-	sessionStore.Create(user.ID, accessToken, ip, userAgent)
-	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(Token{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		TokenType:    "Bearer",
-		ExpiresIn:    3600,
+	token, err := issueTokens(r, Grant{
+		UserID:   user.ID,
+		AuthTime: time.Now(),
+		AMR:      []string{"pwd"},
 	})
-}
-
-func meHandler(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Authorization header required", http.StatusUnauthorized)
+	if err != nil {
+		writeIssueTokenError(w, err)
 		return
 	}
 
-	// Simplified: In production, validate JWT token
-	store.mu.RLock()
-	users := make([]*User, 0, len(store.users))
-	for _, user := range store.users {
-		users = append(users, &User{
-			ID:        user.ID,
-			Email:     user.Email,
-			Name:      user.Name,
-			CreatedAt: user.CreatedAt,
-		})
+	writeSignInResponse(w, token, "", wantsCookieTransport(r))
+}
+
+// authenticateUser checks an email and password against the user store,
+// unless the address is backing off or locked after failed attempts.
+func authenticateUser(r *http.Request, email, password string) (*User, error) {
+	if err := checkLoginAllowed(email, time.Now()); err != nil {
+		return nil, err
+	}
+	user, exists := store.GetByEmail(email)
+	if !exists {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		recordLoginFailure(r, email, nil)
+		return nil, errInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		recordLoginFailure(r, email, user)
+		return nil, errInvalidCredentials
 	}
-	store.mu.RUnlock()
+	clearLoginFailures(email)
+	return user, nil
+}
 
-	if len(users) > 0 {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(users[0])
-	} else {
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromRequest(r)
+	user, exists := store.GetByID(claims.Subject)
+	if !exists {
 		http.Error(w, "User not found", http.StatusNotFound)
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
 }
 
 func generateID() string {
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	issuer, err := newJWTIssuerFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure JWT issuer: %v", err)
+	}
+	jwtIssuer = issuer
+	os.Exit(m.Run())
+}
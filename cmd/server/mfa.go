@@ -0,0 +1,536 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	mfaChallengeTTL         = 5 * time.Minute
+	mfaChallengeMaxAttempts = 5
+	recoveryCodeCount       = 10
+)
+
+var (
+	errMFANotEnrolled     = errors.New("mfa not enrolled")
+	errMFAAlreadyEnabled  = errors.New("mfa already enabled")
+	errMFAInvalidCode     = errors.New("invalid mfa code")
+	errMFAChallengeFailed = errors.New("invalid or expired mfa challenge")
+)
+
+// MFAEnrollment is a user's TOTP secret. It only protects logins once the
+// user has confirmed it with a first code.
+type MFAEnrollment struct {
+	UserID    string
+	Secret    string
+	Confirmed bool
+	// RecoveryCodes holds SHA-256 hashes; each is removed once used
+	RecoveryCodes []string
+	// LastStep is the last accepted TOTP step, so a code can't be replayed
+	LastStep  int64
+	CreatedAt time.Time
+}
+
+// MFAStore is the in-memory MFARepository.
+type MFAStore struct {
+	mu          sync.Mutex
+	enrollments map[string]*MFAEnrollment
+}
+
+var mfaStore MFARepository = &MFAStore{
+	enrollments: make(map[string]*MFAEnrollment),
+}
+
+// Begin starts (or restarts) an unconfirmed enrollment.
+func (ms *MFAStore) Begin(userID, secret string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if e, exists := ms.enrollments[userID]; exists && e.Confirmed {
+		return errMFAAlreadyEnabled
+	}
+	ms.enrollments[userID] = newMFAEnrollment(userID, secret)
+	return nil
+}
+
+// Confirm enables MFA once the user proves their app produces valid codes,
+// and returns freshly generated recovery codes.
+func (ms *MFAStore) Confirm(userID, code string) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	e, exists := ms.enrollments[userID]
+	if !exists {
+		return nil, errMFANotEnrolled
+	}
+	return e.confirm(code, time.Now())
+}
+
+func (ms *MFAStore) Enabled(userID string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	e, exists := ms.enrollments[userID]
+	return exists && e.Confirmed
+}
+
+// VerifyTOTP checks a code from the user's authenticator app.
+func (ms *MFAStore) VerifyTOTP(userID, code string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	e, exists := ms.enrollments[userID]
+	return exists && e.verifyTOTP(code, time.Now())
+}
+
+// UseRecoveryCode consumes one of the user's recovery codes.
+func (ms *MFAStore) UseRecoveryCode(userID, code string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	e, exists := ms.enrollments[userID]
+	return exists && e.useRecoveryCode(code)
+}
+
+func (ms *MFAStore) Disable(userID string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.enrollments, userID)
+}
+
+// get returns a copy of the user's enrollment.
+func (ms *MFAStore) get(userID string) (MFAEnrollment, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	e, exists := ms.enrollments[userID]
+	if !exists {
+		return MFAEnrollment{}, false
+	}
+	copied := *e
+	copied.RecoveryCodes = append([]string(nil), e.RecoveryCodes...)
+	return copied, true
+}
+
+// The methods below hold the enrollment rules every MFARepository applies;
+// they change e in place and leave saving it to the caller.
+
+func newMFAEnrollment(userID, secret string) *MFAEnrollment {
+	return &MFAEnrollment{
+		UserID:    userID,
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}
+}
+
+func (e *MFAEnrollment) confirm(code string, now time.Time) ([]string, error) {
+	if e.Confirmed {
+		return nil, errMFAAlreadyEnabled
+	}
+	step, ok := validateTOTP(e.Secret, code, now)
+	if !ok {
+		return nil, errMFAInvalidCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	e.Confirmed = true
+	e.LastStep = step
+	e.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// verifyTOTP accepts each code only once, and none older than the last
+// accepted one.
+func (e *MFAEnrollment) verifyTOTP(code string, now time.Time) bool {
+	if !e.Confirmed {
+		return false
+	}
+	step, ok := validateTOTP(e.Secret, code, now)
+	if !ok || step <= e.LastStep {
+		return false
+	}
+	e.LastStep = step
+	return true
+}
+
+func (e *MFAEnrollment) useRecoveryCode(code string) bool {
+	if !e.Confirmed {
+		return false
+	}
+	hash := hashRecoveryCode(code)
+	for i, stored := range e.RecoveryCodes {
+		if stored == hash {
+			e.RecoveryCodes = append(e.RecoveryCodes[:i], e.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := totpEncoding.EncodeToString(b)
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code however the user typed it.
+// Recovery codes are random, so a fast hash is enough.
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeUserCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifySecondFactor accepts either a TOTP code or a recovery code. Wrong
+// codes count towards a per-user backoff and lockout, so they can't be
+// guessed across many challenges; it returns a *loginThrottledError
+// without checking the code while that applies.
+func verifySecondFactor(r *http.Request, userID, code string) error {
+	if code == "" {
+		return errMFAInvalidCode
+	}
+	if err := checkSecondFactorAllowed(userID, time.Now()); err != nil {
+		return err
+	}
+	if mfaStore.VerifyTOTP(userID, code) {
+		clearSecondFactorFailures(userID)
+		return nil
+	}
+	if mfaStore.UseRecoveryCode(userID, code) {
+		clearSecondFactorFailures(userID)
+		auditLogger.Log(userID, "mfa_recovery_code_used", "mfa", r.RemoteAddr, nil)
+		return nil
+	}
+	recordSecondFactorFailure(r, userID)
+	return errMFAInvalidCode
+}
+
+// writeMFACodeError answers a second factor code verifySecondFactor
+// rejected.
+func writeMFACodeError(w http.ResponseWriter, err error, status int) {
+	var throttled *loginThrottledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", ceilSeconds(throttled.RetryAfter))
+		http.Error(w, "Too many invalid codes; try again later", http.StatusTooManyRequests)
+		return
+	}
+	http.Error(w, "Invalid code", status)
+}
+
+// formSecondFactor checks the second factor typed into a server-rendered
+// sign-in page. It returns the AMR values to add, or a message for the page
+// if the sign-in must stop. The pages can't run a WebAuthn ceremony, so an
+// account protected only by a passkey is turned away rather than signed in
+// with its password alone.
+func formSecondFactor(r *http.Request, userID, code string) ([]string, string) {
+	if !hasSecondFactor(userID) {
+		return nil, ""
+	}
+	if !mfaStore.Enabled(userID) {
+		return nil, "This account is protected by a passkey, which this page can't use. Sign in with your passkey instead"
+	}
+	if err := verifySecondFactor(r, userID, code); err != nil {
+		if err != errMFAInvalidCode {
+			return nil, "Too many invalid authentication codes. Try again later"
+		}
+		return nil, "Invalid or missing authentication code"
+	}
+	return []string{"otp", "mfa"}, ""
+}
+
+// MFAChallenge is handed out by loginHandler after a correct password when
+// the user still has to present a second factor.
+type MFAChallenge struct {
+	Token  string
+	UserID string
+	// AMR records the first factor the user already presented
+	AMR       []string
+	Attempts  int
+	ExpiresAt time.Time
+}
+
+var mfaChallenges = &struct {
+	mu         sync.Mutex
+	challenges map[string]*MFAChallenge
+}{
+	challenges: make(map[string]*MFAChallenge),
+}
+
+// deleteExpiredMFAChallenges drops sign-ins that never got their second
+// factor.
+func deleteExpiredMFAChallenges(now time.Time) int {
+	mfaChallenges.mu.Lock()
+	defer mfaChallenges.mu.Unlock()
+
+	n := 0
+	for token, challenge := range mfaChallenges.challenges {
+		if now.After(challenge.ExpiresAt) {
+			delete(mfaChallenges.challenges, token)
+			n++
+		}
+	}
+	return n
+}
+
+func createMFAChallenge(userID string, amr []string) *MFAChallenge {
+	challenge := &MFAChallenge{
+		Token:     generateToken(),
+		UserID:    userID,
+		AMR:       amr,
+		ExpiresAt: time.Now().Add(mfaChallengeTTL),
+	}
+	mfaChallenges.mu.Lock()
+	mfaChallenges.challenges[challenge.Token] = challenge
+	mfaChallenges.mu.Unlock()
+	return challenge
+}
+
+// writeMFAChallenge answers a login that needs a second factor.
+func writeMFAChallenge(w http.ResponseWriter, userID string, amr []string) {
+	challenge := createMFAChallenge(userID, amr)
+	var methods []string
+	if mfaStore.Enabled(userID) {
+		methods = append(methods, "totp", "recovery_code")
+	}
+	if passkeyStore.HasPasskeys(userID) {
+		methods = append(methods, "webauthn")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mfa_required": true,
+		"mfa_token":    challenge.Token,
+		"methods":      methods,
+		"expires_in":   int(mfaChallengeTTL.Seconds()),
+	})
+}
+
+func enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Adding a second factor next to an existing one changes how the
+	// account is protected, so it needs the same step-up as removing one
+	claims, _ := claimsFromRequest(r)
+	if hasSecondFactor(claims.Subject) && !checkStepUp(w, r) {
+		return
+	}
+	user, exists := store.GetByID(claims.Subject)
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+	if err := mfaStore.Begin(user.ID, secret); err != nil {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totpURI("go-auth-api", user.Email, secret),
+		"message":     "Scan the code with your authenticator app, then confirm with a code",
+	})
+}
+
+func confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := claimsFromRequest(r)
+	if hasSecondFactor(claims.Subject) && !checkStepUp(w, r) {
+		return
+	}
+	codes, err := mfaStore.Confirm(claims.Subject, req.Code)
+	switch err {
+	case nil:
+	case errMFANotEnrolled:
+		http.Error(w, "Start enrollment first", http.StatusBadRequest)
+		return
+	case errMFAAlreadyEnabled:
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	case errMFAInvalidCode:
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	auditLogger.Log(claims.Subject, "mfa_enabled", "mfa", r.RemoteAddr, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes, // Only shown once
+	})
+}
+
+func disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := claimsFromRequest(r)
+	if !mfaStore.Enabled(claims.Subject) {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	if err := verifySecondFactor(r, claims.Subject, req.Code); err != nil {
+		writeMFACodeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	mfaStore.Disable(claims.Subject)
+	trustedDevices.RevokeAll(claims.Subject)
+	auditLogger.Log(claims.Subject, "mfa_disabled", "mfa", r.RemoteAddr, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// verifyMFAHandler completes a login started by loginHandler.
+func verifyMFAHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		MFAToken       string `json:"mfa_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+		RememberDevice bool   `json:"remember_device"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	code := req.Code
+	if code == "" {
+		code = req.RecoveryCode
+	}
+
+	challenge, err := redeemMFAChallenge(req.MFAToken, func(userID string) error {
+		return verifySecondFactor(r, userID, code)
+	})
+	if err != nil && err != errMFAChallengeFailed {
+		writeMFACodeError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := issueTokens(r, Grant{
+		UserID:   challenge.UserID,
+		AuthTime: time.Now(),
+		AMR:      append(challenge.AMR, "otp", "mfa"),
+	})
+	if err != nil {
+		writeIssueTokenError(w, err)
+		return
+	}
+
+	var trustedDeviceToken string
+	if req.RememberDevice {
+		trustedDeviceToken = issueTrustedDevice(r, challenge.UserID)
+	}
+	writeSignInResponse(w, token, trustedDeviceToken, wantsCookieTransport(r))
+}
+
+// redeemMFAChallenge runs verify against the challenge's user, returning
+// its error if it fails. The challenge is consumed on success and after
+// too many failed attempts.
+func redeemMFAChallenge(token string, verify func(userID string) error) (*MFAChallenge, error) {
+	mfaChallenges.mu.Lock()
+	challenge, exists := mfaChallenges.challenges[token]
+	if !exists || time.Now().After(challenge.ExpiresAt) {
+		delete(mfaChallenges.challenges, token)
+		mfaChallenges.mu.Unlock()
+		return nil, errMFAChallengeFailed
+	}
+	challenge.Attempts++
+	if challenge.Attempts > mfaChallengeMaxAttempts {
+		delete(mfaChallenges.challenges, token)
+		mfaChallenges.mu.Unlock()
+		return nil, errMFAChallengeFailed
+	}
+	mfaChallenges.mu.Unlock()
+
+	if err := verify(challenge.UserID); err != nil {
+		return nil, err
+	}
+
+	mfaChallenges.mu.Lock()
+	delete(mfaChallenges.challenges, token)
+	mfaChallenges.mu.Unlock()
+	return challenge, nil
+}
+
+// mfaChallengeUser returns who a pending challenge belongs to without
+// consuming it.
+func mfaChallengeUser(token string) (string, bool) {
+	mfaChallenges.mu.Lock()
+	defer mfaChallenges.mu.Unlock()
+
+	challenge, exists := mfaChallenges.challenges[token]
+	if !exists || time.Now().After(challenge.ExpiresAt) {
+		return "", false
+	}
+	return challenge.UserID, true
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed from RFC 6238 Appendix B,
+// "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	// Appendix B lists 8-digit codes; 6-digit codes are their last 6 digits
+	for _, tc := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		got, err := totpCode(rfc6238Secret, tc.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("T=%d: got %s, want %s", tc.unix, got, tc.want)
+		}
+	}
+}
+
+func TestValidateTOTPSkewWindow(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+
+	for _, tc := range []struct {
+		offset int64
+		ok     bool
+	}{
+		{-2, false},
+		{-1, true},
+		{0, true},
+		{1, true},
+		{2, false},
+	} {
+		code, err := totpCode(rfc6238Secret, current+tc.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := validateTOTP(rfc6238Secret, code, now)
+		if ok != tc.ok {
+			t.Errorf("step %+d: got ok=%v, want %v", tc.offset, ok, tc.ok)
+		}
+		if ok && step != current+tc.offset {
+			t.Errorf("step %+d: matched step %d, want %d", tc.offset, step, current+tc.offset)
+		}
+	}
+
+	if _, ok := validateTOTP(rfc6238Secret, "50471", now); ok {
+		t.Error("accepted a code of the wrong length")
+	}
+}
+
+func TestVerifyTOTPRejectsReusedCode(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	e := &MFAEnrollment{UserID: "mfa-user", Secret: rfc6238Secret, Confirmed: true}
+
+	code, _ := totpCode(rfc6238Secret, current)
+	if !e.verifyTOTP(code, now) {
+		t.Fatal("valid code rejected")
+	}
+	if e.verifyTOTP(code, now) {
+		t.Error("same code accepted twice")
+	}
+	if e.verifyTOTP(code, now.Add(totpPeriod*time.Second)) {
+		t.Error("same code accepted again in the next step")
+	}
+
+	// A code from an earlier step is refused once a later one was used
+	previous, _ := totpCode(rfc6238Secret, current-1)
+	if e.verifyTOTP(previous, now) {
+		t.Error("code older than the last accepted one accepted")
+	}
+
+	next, _ := totpCode(rfc6238Secret, current+1)
+	if !e.verifyTOTP(next, now.Add(totpPeriod*time.Second)) {
+		t.Error("code for the next step rejected")
+	}
+}
+
+func TestMFAStoreConfirmThenVerify(t *testing.T) {
+	ms := &MFAStore{enrollments: make(map[string]*MFAEnrollment)}
+	if err := ms.Begin("mfa-user", rfc6238Secret); err != nil {
+		t.Fatal(err)
+	}
+	if ms.Enabled("mfa-user") {
+		t.Fatal("enabled before confirmation")
+	}
+
+	code, _ := totpCode(rfc6238Secret, time.Now().Unix()/totpPeriod)
+	codes, err := ms.Confirm("mfa-user", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ms.Enabled("mfa-user") || len(codes) != recoveryCodeCount {
+		t.Fatalf("enabled=%v with %d recovery codes", ms.Enabled("mfa-user"), len(codes))
+	}
+
+	// The confirming code counts as used
+	if ms.VerifyTOTP("mfa-user", code) {
+		t.Error("confirmation code accepted again")
+	}
+	if !ms.UseRecoveryCode("mfa-user", codes[0]) || ms.UseRecoveryCode("mfa-user", codes[0]) {
+		t.Error("recovery code not single-use")
+	}
+}
+
+func TestSecondFactorFailuresOutliveCorrectPassword(t *testing.T) {
+	userID, email := "mfa-guess-user", "mfa-guess@example.com"
+	t.Cleanup(func() { clearSecondFactorFailures(userID) })
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/mfa/verify", nil)
+
+	for i := 0; i < loginBackoffAfter; i++ {
+		if err := verifySecondFactor(r, userID, "000000"); err != errMFAInvalidCode {
+			t.Fatalf("wrong code %d: %v", i, err)
+		}
+	}
+
+	// A correct password, as each new MFA challenge needs, settles only
+	// the password attempt
+	clearLoginFailures(email)
+	var throttled *loginThrottledError
+	if err := verifySecondFactor(r, userID, "000000"); !errors.As(err, &throttled) {
+		t.Fatalf("code checked during backoff: %v", err)
+	}
+}
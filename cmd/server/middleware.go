@@ -18,19 +18,59 @@ func loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
+		var token string
+		if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+			if !strings.HasPrefix(authHeader, "Bearer ") {
+				http.Error(w, "Invalid authorization format", http.StatusUnauthorized)
+				return
+			}
+			token = strings.TrimPrefix(authHeader, "Bearer ")
+		} else if cookie, err := r.Cookie(sessionCookieName()); err == nil {
+			// Browsers attach cookies to cross-site requests too
+			if !checkCSRF(r) {
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+			token = cookie.Value
+		} else {
 			http.Error(w, "Authorization header required", http.StatusUnauthorized)
 			return
 		}
 
-		if !strings.HasPrefix(authHeader, "Bearer ") {
-			http.Error(w, "Invalid authorization format", http.StatusUnauthorized)
+		claims, err := jwtIssuer.Verify(token)
+		if err != nil {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+		// Client credentials tokens act for no user, so user routes have
+		// nothing to serve them
+		if claims.Subject == "" {
+			http.Error(w, "User token required", http.StatusForbidden)
 			return
 		}
 
-		// In production, validate JWT token here
-		next(w, r)
+		// Signature alone can't tell us about logout, so the session must still exist
+		session, exists := sessionStore.Get(token)
+		if !exists {
+			http.Error(w, "Session expired or revoked", http.StatusUnauthorized)
+			return
+		}
+
+		// The store's ExpiresAt was computed when the session was last
+		// used; checking again applies policy changes to existing sessions
+		now := time.Now()
+		if now.After(sessionExpiry(session, session.LastSeenAt)) {
+			sessionStore.Delete(token)
+			http.Error(w, "Session expired", http.StatusUnauthorized)
+			return
+		}
+		if now.Sub(session.LastSeenAt) > sessionPolicyFor(session.ClientID).touchInterval() {
+			session.LastSeenAt = now
+			session.ExpiresAt = sessionExpiry(session, now)
+			sessionStore.Touch(token, session.LastSeenAt, session.ExpiresAt)
+		}
+
+		next(w, withSession(withClaims(r, claims), session))
 	}
 }
 
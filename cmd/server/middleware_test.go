@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthMiddlewareRequiresUserToken(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/oauth/token", nil)
+	clientToken, err := issueAccessToken(r, Grant{ClientID: "svcA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userToken, err := issueAccessToken(r, Grant{UserID: "middleware-user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sessionStore.Delete(clientToken.AccessToken)
+		sessionStore.Delete(userToken.AccessToken)
+	})
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"client token", clientToken.AccessToken, http.StatusForbidden},
+		{"user token", userToken.AccessToken, http.StatusOK},
+	} {
+		called := false
+		handler := authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		})
+		r := httptest.NewRequest(http.MethodGet, "/api/users/me", nil)
+		r.Header.Set("Authorization", "Bearer "+tc.token)
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, w.Code, tc.want)
+		}
+		if called != (tc.want == http.StatusOK) {
+			t.Errorf("%s: handler called = %v", tc.name, called)
+		}
+	}
+}
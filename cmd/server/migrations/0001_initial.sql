@@ -0,0 +1,57 @@
+-- Times are Unix milliseconds; 0 means unset. AMR values are space-separated.
+
+CREATE TABLE users (
+    id             TEXT PRIMARY KEY,
+    email          TEXT NOT NULL UNIQUE,
+    password_hash  TEXT NOT NULL,
+    name           TEXT NOT NULL DEFAULT '',
+    email_verified INTEGER NOT NULL DEFAULT 0,
+    created_at     INTEGER NOT NULL
+);
+
+CREATE TABLE sessions (
+    token      TEXT PRIMARY KEY,
+    user_id    TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    expires_at INTEGER NOT NULL,
+    ip_address TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    auth_time  INTEGER NOT NULL DEFAULT 0,
+    amr        TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX sessions_user_id ON sessions (user_id);
+
+CREATE TABLE refresh_tokens (
+    token      TEXT PRIMARY KEY,
+    user_id    TEXT NOT NULL,
+    family_id  TEXT NOT NULL,
+    client_id  TEXT NOT NULL DEFAULT '',
+    scope      TEXT NOT NULL DEFAULT '',
+    auth_time  INTEGER NOT NULL DEFAULT 0,
+    amr        TEXT NOT NULL DEFAULT '',
+    expires_at INTEGER NOT NULL,
+    rotated_at INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX refresh_tokens_family_id ON refresh_tokens (family_id);
+
+-- Sessions issued alongside a refresh token family, revoked with it
+CREATE TABLE token_family_sessions (
+    family_id     TEXT NOT NULL,
+    session_token TEXT NOT NULL,
+    PRIMARY KEY (family_id, session_token)
+);
+
+CREATE TABLE password_reset_tokens (
+    token      TEXT PRIMARY KEY,
+    user_id    TEXT NOT NULL,
+    expires_at INTEGER NOT NULL
+);
+
+CREATE TABLE verification_tokens (
+    token      TEXT PRIMARY KEY,
+    user_id    TEXT NOT NULL,
+    email      TEXT NOT NULL,
+    expires_at INTEGER NOT NULL
+);
@@ -0,0 +1,8 @@
+-- Emails are unique regardless of case. The application fills
+-- email_normalized; existing rows are backfilled with SQLite's lower().
+
+ALTER TABLE users ADD COLUMN email_normalized TEXT NOT NULL DEFAULT '';
+
+UPDATE users SET email_normalized = lower(trim(email));
+
+CREATE UNIQUE INDEX idx_users_email_normalized ON users (email_normalized);
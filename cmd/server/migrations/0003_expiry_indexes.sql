@@ -0,0 +1,9 @@
+-- The janitor deletes by expiry time.
+
+CREATE INDEX sessions_expires_at ON sessions (expires_at);
+
+CREATE INDEX refresh_tokens_expires_at ON refresh_tokens (expires_at);
+
+CREATE INDEX password_reset_tokens_expires_at ON password_reset_tokens (expires_at);
+
+CREATE INDEX verification_tokens_expires_at ON verification_tokens (expires_at);
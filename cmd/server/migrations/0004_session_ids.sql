@@ -0,0 +1,10 @@
+-- Sessions are listed and revoked by the ID of their sign-in, which every
+-- refreshed access token shares.
+
+ALTER TABLE sessions ADD COLUMN id TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE sessions ADD COLUMN last_seen_at INTEGER NOT NULL DEFAULT 0;
+
+UPDATE sessions SET id = token, last_seen_at = created_at;
+
+CREATE INDEX refresh_tokens_user_id ON refresh_tokens (user_id);
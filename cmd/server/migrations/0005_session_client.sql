@@ -0,0 +1,3 @@
+-- Session limits depend on the kind of client a session was issued to.
+
+ALTER TABLE sessions ADD COLUMN client_id TEXT NOT NULL DEFAULT '';
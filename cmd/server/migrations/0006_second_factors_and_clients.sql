@@ -0,0 +1,54 @@
+-- Second factors, remembered browsers and OAuth clients, which were only
+-- kept in memory before. Lists are space-separated, like amr.
+
+CREATE TABLE mfa_enrollments (
+    user_id        TEXT PRIMARY KEY,
+    secret         TEXT NOT NULL,
+    confirmed      INTEGER NOT NULL DEFAULT 0,
+    recovery_codes TEXT NOT NULL DEFAULT '',
+    last_step      INTEGER NOT NULL DEFAULT 0,
+    created_at     INTEGER NOT NULL
+);
+
+CREATE TABLE passkeys (
+    id           TEXT PRIMARY KEY,
+    user_id      TEXT NOT NULL,
+    name         TEXT NOT NULL DEFAULT '',
+    public_key   BLOB NOT NULL,
+    algorithm    INTEGER NOT NULL,
+    sign_count   INTEGER NOT NULL DEFAULT 0,
+    transports   TEXT NOT NULL DEFAULT '',
+    aaguid       TEXT NOT NULL DEFAULT '',
+    created_at   INTEGER NOT NULL,
+    last_used_at INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX passkeys_user_id ON passkeys (user_id);
+
+CREATE TABLE trusted_devices (
+    token_hash   TEXT PRIMARY KEY,
+    id           TEXT NOT NULL,
+    user_id      TEXT NOT NULL,
+    user_agent   TEXT NOT NULL DEFAULT '',
+    ip_address   TEXT NOT NULL DEFAULT '',
+    created_at   INTEGER NOT NULL,
+    last_used_at INTEGER NOT NULL DEFAULT 0,
+    expires_at   INTEGER NOT NULL
+);
+
+CREATE INDEX trusted_devices_user_id ON trusted_devices (user_id);
+
+CREATE INDEX trusted_devices_expires_at ON trusted_devices (expires_at);
+
+-- token_exchange is the client's ExchangePolicy as JSON, '' for none
+CREATE TABLE oauth_clients (
+    id             TEXT PRIMARY KEY,
+    name           TEXT NOT NULL DEFAULT '',
+    secret_hash    TEXT NOT NULL DEFAULT '',
+    public         INTEGER NOT NULL DEFAULT 0,
+    disabled       INTEGER NOT NULL DEFAULT 0,
+    redirect_uris  TEXT NOT NULL DEFAULT '',
+    scopes         TEXT NOT NULL DEFAULT '',
+    token_exchange TEXT NOT NULL DEFAULT '',
+    created_at     INTEGER NOT NULL
+);
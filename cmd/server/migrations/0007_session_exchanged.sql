@@ -0,0 +1,4 @@
+-- Tokens minted by token exchange keep a session for revocation, but
+-- aren't sign-ins the user sees or that count towards the session limit.
+
+ALTER TABLE sessions ADD COLUMN exchanged INTEGER NOT NULL DEFAULT 0;
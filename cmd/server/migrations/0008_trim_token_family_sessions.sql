@@ -0,0 +1,6 @@
+-- A family now links only the session issued with its newest refresh
+-- token; earlier ones are found by the family's session ID. Drop the rows
+-- that accumulated before, keeping the newest of each family.
+
+DELETE FROM token_family_sessions
+WHERE rowid NOT IN (SELECT MAX(rowid) FROM token_family_sessions GROUP BY family_id);
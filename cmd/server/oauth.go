@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// writeOAuthError writes an RFC 6749 section 5.2 error response.
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="go-auth-api"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func writeTokenResponse(w http.ResponseWriter, token interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	json.NewEncoder(w).Encode(token)
+}
+
+func parseScope(scope string) []string {
+	return strings.Fields(scope)
+}
+
+// scopeSubset reports whether every scope in requested is also in allowed.
+func scopeSubset(requested, allowed []string) bool {
+	set := make(map[string]bool, len(allowed))
+	for _, s := range allowed {
+		set[s] = true
+	}
+	for _, s := range requested {
+		if !set[s] {
+			return false
+		}
+	}
+	return true
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range parseScope(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var errOIDCDisabled = errors.New("openid connect needs an RS256 or ES256 signing key")
+
+// oidcEnabled reports whether ID tokens can be issued. They are signed with
+// the same key as access tokens, and an HS256 secret can't be published for
+// relying parties to verify with, so OpenID Connect needs RS256 or ES256.
+func oidcEnabled() bool {
+	return jwtIssuer.keys.Active().Algorithm != "HS256"
+}
+
+// UserInfo holds the standard claims returned by /userinfo and embedded in
+// ID tokens.
+type UserInfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+}
+
+// IDTokenClaims is the OpenID Connect ID token payload.
+type IDTokenClaims struct {
+	UserInfo
+	Issuer    string   `json:"iss"`
+	Audience  string   `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	IssuedAt  int64    `json:"iat"`
+	AuthTime  int64    `json:"auth_time"`
+	Nonce     string   `json:"nonce,omitempty"`
+	AMR       []string `json:"amr,omitempty"`
+}
+
+// issueIDToken signs an ID token for the user a code was issued to. The
+// audience is the client, not this API.
+func issueIDToken(code *AuthorizationCode, clientID string) (string, error) {
+	if !oidcEnabled() {
+		return "", errOIDCDisabled
+	}
+	user, exists := store.GetByID(code.UserID)
+	if !exists {
+		return "", errInvalidToken
+	}
+
+	now := time.Now()
+	claims := &IDTokenClaims{
+		UserInfo:  newUserInfo(user, code.Scope),
+		Issuer:    jwtIssuer.issuer,
+		Audience:  clientID,
+		ExpiresAt: now.Add(jwtIssuer.ttl).Unix(),
+		IssuedAt:  now.Unix(),
+		AuthTime:  code.AuthTime.Unix(),
+		Nonce:     code.Nonce,
+		AMR:       code.AMR,
+	}
+
+	return jwtIssuer.Sign(claims)
+}
+
+// newUserInfo returns the standard claims the granted scope allows.
+func newUserInfo(user *User, scope string) UserInfo {
+	info := UserInfo{Subject: user.ID}
+	if hasScope(scope, "email") {
+		verified := user.EmailVerified
+		info.Email = user.Email
+		info.EmailVerified = &verified
+	}
+	if hasScope(scope, "profile") {
+		info.Name = user.Name
+	}
+	return info
+}
+
+func userInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, _ := claimsFromRequest(r)
+	if !hasScope(claims.Scope, "openid") {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		http.Error(w, "openid scope required", http.StatusForbidden)
+		return
+	}
+
+	user, exists := store.GetByID(claims.Subject)
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(newUserInfo(user, claims.Scope))
+}
+
+func discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !oidcEnabled() {
+		http.Error(w, "OpenID Connect requires JWT_ALGORITHM=RS256 or ES256", http.StatusNotFound)
+		return
+	}
+
+	base := jwtIssuer.issuer
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                base,
+		"authorization_endpoint":                base + "/oauth/authorize",
+		"token_endpoint":                        base + "/oauth/token",
+		"userinfo_endpoint":                     base + "/userinfo",
+		"jwks_uri":                              base + "/.well-known/jwks.json",
+		"introspection_endpoint":                base + "/api/oauth/introspect",
+		"revocation_endpoint":                   base + "/api/oauth/revoke",
+		"device_authorization_endpoint":         base + "/oauth/device_authorization",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token", "client_credentials", deviceCodeGrantType, tokenExchangeGrantType},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{jwtIssuer.keys.Active().Algorithm},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "amr", "email", "email_verified", "name"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func withSigningAlgorithm(t *testing.T, algorithm string) {
+	t.Helper()
+	key, err := generateSigningKey(algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := jwtIssuer
+	jwtIssuer = &JWTIssuer{
+		issuer:   saved.issuer,
+		audience: saved.audience,
+		ttl:      saved.ttl,
+		keys:     newKeyManager(key, saved.ttl),
+	}
+	t.Cleanup(func() { jwtIssuer = saved })
+}
+
+func TestDiscoveryAdvertisesVerifiableAlgorithms(t *testing.T) {
+	for _, tc := range []struct {
+		algorithm string
+		want      int
+	}{
+		{"HS256", http.StatusNotFound},
+		{"RS256", http.StatusOK},
+		{"ES256", http.StatusOK},
+	} {
+		t.Run(tc.algorithm, func(t *testing.T) {
+			withSigningAlgorithm(t, tc.algorithm)
+
+			w := httptest.NewRecorder()
+			discoveryHandler(w, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil))
+			if w.Code != tc.want {
+				t.Fatalf("got %d, want %d", w.Code, tc.want)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var doc struct {
+				Algorithms []string `json:"id_token_signing_alg_values_supported"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+				t.Fatal(err)
+			}
+			if len(doc.Algorithms) != 1 || doc.Algorithms[0] != tc.algorithm {
+				t.Errorf("got algorithms %v, want [%s]", doc.Algorithms, tc.algorithm)
+			}
+		})
+	}
+}
+
+func TestIssueIDTokenRequiresAsymmetricKey(t *testing.T) {
+	withSigningAlgorithm(t, "HS256")
+	if _, err := issueIDToken(&AuthorizationCode{UserID: "oidc-user"}, "svcA"); err != errOIDCDisabled {
+		t.Errorf("got %v, want errOIDCDisabled", err)
+	}
+}
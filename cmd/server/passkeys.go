@@ -0,0 +1,638 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	webauthnCeremonyTTL = 5 * time.Minute
+	// Attestation objects are a few hundred bytes, RSA keys included
+	webauthnMaxBodyBytes = 64 << 10
+)
+
+var (
+	errPasskeyExists   = errors.New("passkey already registered")
+	errPasskeyNotFound = errors.New("passkey not found")
+	errPasskeyCloned   = errors.New("passkey sign count went backwards")
+)
+
+// WebAuthnCredential is a passkey registered to a user.
+type WebAuthnCredential struct {
+	ID     string // base64url credential ID
+	UserID string
+	Name   string
+	// PublicKey is PKIX DER; Algorithm is the COSE algorithm it signs with
+	PublicKey  []byte
+	Algorithm  int64
+	SignCount  uint32
+	Transports []string
+	AAGUID     string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+// PasskeyStore is the in-memory PasskeyRepository.
+type PasskeyStore struct {
+	mu          sync.RWMutex
+	credentials map[string]*WebAuthnCredential
+}
+
+var passkeyStore PasskeyRepository = &PasskeyStore{
+	credentials: make(map[string]*WebAuthnCredential),
+}
+
+func (ps *PasskeyStore) Add(cred *WebAuthnCredential) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if _, exists := ps.credentials[cred.ID]; exists {
+		return errPasskeyExists
+	}
+	ps.credentials[cred.ID] = cred
+	return nil
+}
+
+func (ps *PasskeyStore) Get(id string) (WebAuthnCredential, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	cred, exists := ps.credentials[id]
+	if !exists {
+		return WebAuthnCredential{}, false
+	}
+	return *cred, true
+}
+
+func (ps *PasskeyStore) ListByUser(userID string) []WebAuthnCredential {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	var creds []WebAuthnCredential
+	for _, cred := range ps.credentials {
+		if cred.UserID == userID {
+			creds = append(creds, *cred)
+		}
+	}
+	return creds
+}
+
+func (ps *PasskeyStore) HasPasskeys(userID string) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	for _, cred := range ps.credentials {
+		if cred.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordUse stores the authenticator's new sign count.
+func (ps *PasskeyStore) RecordUse(id string, signCount uint32) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	cred, exists := ps.credentials[id]
+	if !exists {
+		return errPasskeyNotFound
+	}
+	if !signCountAdvances(cred.SignCount, signCount) {
+		return errPasskeyCloned
+	}
+	cred.SignCount = signCount
+	cred.LastUsedAt = time.Now()
+	return nil
+}
+
+// signCountAdvances reports whether an assertion's sign count may follow
+// the stored one. A counter that does not move forward suggests the
+// credential has been cloned (WebAuthn section 6.1.1); authenticators that
+// don't count always report zero.
+func signCountAdvances(stored, signCount uint32) bool {
+	return signCount > stored || (signCount == 0 && stored == 0)
+}
+
+func (ps *PasskeyStore) Delete(userID, id string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	cred, exists := ps.credentials[id]
+	if !exists || cred.UserID != userID {
+		return false
+	}
+	delete(ps.credentials, id)
+	return true
+}
+
+// webauthnCeremony is a pending registration or login, keyed by the
+// challenge the browser echoes back in clientDataJSON.
+type webauthnCeremony struct {
+	Challenge    string
+	Registration bool
+	// UserID is set for registration and second-factor logins; a
+	// passwordless login learns the user from the credential
+	UserID   string
+	MFAToken string
+	// RememberDevice asks for a trusted device token once the second
+	// factor succeeds
+	RememberDevice bool
+	RequireUV      bool
+	ExpiresAt      time.Time
+}
+
+var webauthnCeremonies = &struct {
+	mu         sync.Mutex
+	ceremonies map[string]*webauthnCeremony
+}{
+	ceremonies: make(map[string]*webauthnCeremony),
+}
+
+// deleteExpiredCeremonies drops challenges the browser never answered.
+func deleteExpiredCeremonies(now time.Time) int {
+	webauthnCeremonies.mu.Lock()
+	defer webauthnCeremonies.mu.Unlock()
+
+	n := 0
+	for challenge, c := range webauthnCeremonies.ceremonies {
+		if now.After(c.ExpiresAt) {
+			delete(webauthnCeremonies.ceremonies, challenge)
+			n++
+		}
+	}
+	return n
+}
+
+func beginCeremony(c *webauthnCeremony) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	c.Challenge = base64.RawURLEncoding.EncodeToString(b)
+	c.ExpiresAt = time.Now().Add(webauthnCeremonyTTL)
+
+	webauthnCeremonies.mu.Lock()
+	webauthnCeremonies.ceremonies[c.Challenge] = c
+	webauthnCeremonies.mu.Unlock()
+	return nil
+}
+
+// takeCeremony removes and returns a pending ceremony so its challenge can
+// only be answered once.
+func takeCeremony(challenge string, registration bool) (*webauthnCeremony, bool) {
+	webauthnCeremonies.mu.Lock()
+	defer webauthnCeremonies.mu.Unlock()
+
+	c, exists := webauthnCeremonies.ceremonies[challenge]
+	if !exists {
+		return nil, false
+	}
+	delete(webauthnCeremonies.ceremonies, challenge)
+	if c.Registration != registration || time.Now().After(c.ExpiresAt) {
+		return nil, false
+	}
+	return c, true
+}
+
+// credentialResponse is a PublicKeyCredential as serialized by the
+// browser, with binary fields base64url-encoded.
+type credentialResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		AuthenticatorData string   `json:"authenticatorData"`
+		Signature         string   `json:"signature"`
+		UserHandle        string   `json:"userHandle"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+type credentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+func credentialDescriptors(userID string) []credentialDescriptor {
+	descriptors := []credentialDescriptor{}
+	for _, cred := range passkeyStore.ListByUser(userID) {
+		descriptors = append(descriptors, credentialDescriptor{
+			Type:       "public-key",
+			ID:         cred.ID,
+			Transports: cred.Transports,
+		})
+	}
+	return descriptors
+}
+
+func beginPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, _ := claimsFromRequest(r)
+	user, exists := store.GetByID(claims.Subject)
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	ceremony := &webauthnCeremony{Registration: true, UserID: user.ID}
+	if err := beginCeremony(ceremony); err != nil {
+		http.Error(w, "Failed to start registration", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"challenge": ceremony.Challenge,
+			"rp": map[string]string{
+				"id":   relyingParty.ID,
+				"name": relyingParty.Name,
+			},
+			"user": map[string]string{
+				"id":          base64.RawURLEncoding.EncodeToString([]byte(user.ID)),
+				"name":        user.Email,
+				"displayName": user.Name,
+			},
+			"pubKeyCredParams": []map[string]interface{}{
+				{"type": "public-key", "alg": coseAlgES256},
+				{"type": "public-key", "alg": coseAlgRS256},
+			},
+			"timeout":            webauthnCeremonyTTL.Milliseconds(),
+			"attestation":        "none",
+			"excludeCredentials": credentialDescriptors(user.ID),
+			"authenticatorSelection": map[string]string{
+				"residentKey":      "preferred",
+				"userVerification": "preferred",
+			},
+		},
+	})
+}
+
+func finishPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name       string             `json:"name"`
+		Credential credentialResponse `json:"credential"`
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, webauthnMaxBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims, _ := claimsFromRequest(r)
+	clientDataJSON, err := decodeBase64URL(req.Credential.Response.ClientDataJSON)
+	if err != nil {
+		http.Error(w, "Invalid credential", http.StatusBadRequest)
+		return
+	}
+	clientData, err := parseClientData(clientDataJSON)
+	if err != nil {
+		http.Error(w, "Invalid credential", http.StatusBadRequest)
+		return
+	}
+	ceremony, ok := takeCeremony(clientData.Challenge, true)
+	if !ok || ceremony.UserID != claims.Subject {
+		http.Error(w, "Invalid or expired challenge", http.StatusBadRequest)
+		return
+	}
+	if err := relyingParty.verifyClientData(clientData, "webauthn.create", ceremony.Challenge); err != nil {
+		http.Error(w, "Invalid credential", http.StatusBadRequest)
+		return
+	}
+
+	attestationObject, err := decodeBase64URL(req.Credential.Response.AttestationObject)
+	if err != nil {
+		http.Error(w, "Invalid credential", http.StatusBadRequest)
+		return
+	}
+	authData, err := parseAttestationObject(attestationObject)
+	if err != nil {
+		http.Error(w, "Invalid credential", http.StatusBadRequest)
+		return
+	}
+	if err := relyingParty.verifyAuthenticatorData(authData, false); err != nil {
+		http.Error(w, "Invalid credential", http.StatusBadRequest)
+		return
+	}
+	pub, alg, err := parseCOSEKey(authData.PublicKey)
+	if err != nil {
+		http.Error(w, "Unsupported credential algorithm", http.StatusBadRequest)
+		return
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		http.Error(w, "Unsupported credential algorithm", http.StatusBadRequest)
+		return
+	}
+
+	name := req.Name
+	if name == "" {
+		name = "Passkey"
+	}
+	cred := &WebAuthnCredential{
+		ID:         base64.RawURLEncoding.EncodeToString(authData.CredentialID),
+		UserID:     claims.Subject,
+		Name:       name,
+		PublicKey:  der,
+		Algorithm:  alg,
+		SignCount:  authData.SignCount,
+		Transports: req.Credential.Response.Transports,
+		AAGUID:     formatAAGUID(authData.AAGUID),
+		CreatedAt:  time.Now(),
+	}
+	if err := passkeyStore.Add(cred); err != nil {
+		http.Error(w, "Passkey already registered", http.StatusConflict)
+		return
+	}
+
+	auditLogger.Log(claims.Subject, "passkey_registered", "passkey", r.RemoteAddr, map[string]interface{}{
+		"credential_id": cred.ID,
+		"aaguid":        cred.AAGUID,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newPasskeyInfo(cred))
+}
+
+// beginPasskeyLoginHandler starts an assertion. With an mfa_token it is the
+// second step of a password login; without one it is a passwordless login
+// with a discoverable credential.
+func beginPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		MFAToken       string `json:"mfa_token"`
+		RememberDevice bool   `json:"remember_device"`
+	}
+
+	if r.ContentLength != 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, webauthnMaxBodyBytes)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ceremony := &webauthnCeremony{RequireUV: true}
+	allow := []credentialDescriptor{}
+	if req.MFAToken != "" {
+		userID, ok := mfaChallengeUser(req.MFAToken)
+		if !ok {
+			http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+			return
+		}
+		// The password was the first factor, so presence is enough here
+		ceremony.UserID = userID
+		ceremony.MFAToken = req.MFAToken
+		ceremony.RememberDevice = req.RememberDevice
+		ceremony.RequireUV = false
+		allow = credentialDescriptors(userID)
+	}
+	if err := beginCeremony(ceremony); err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	userVerification := "required"
+	if !ceremony.RequireUV {
+		userVerification = "discouraged"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"challenge":        ceremony.Challenge,
+			"rpId":             relyingParty.ID,
+			"timeout":          webauthnCeremonyTTL.Milliseconds(),
+			"allowCredentials": allow,
+			"userVerification": userVerification,
+		},
+	})
+}
+
+func finishPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req credentialResponse
+	r.Body = http.MaxBytesReader(w, r.Body, webauthnMaxBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	cred, ceremony, err := verifyPasskeyAssertion(&req)
+	if err != nil {
+		http.Error(w, "Passkey verification failed", http.StatusUnauthorized)
+		return
+	}
+
+	// A user-verified passkey is multi-factor on its own
+	amr := []string{"hwk", "mfa"}
+	if ceremony.MFAToken != "" {
+		challenge, err := redeemMFAChallenge(ceremony.MFAToken, func(userID string) error {
+			if userID != cred.UserID {
+				return errMFAInvalidCode
+			}
+			return nil
+		})
+		if err != nil {
+			http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+			return
+		}
+		amr = append(challenge.AMR, amr...)
+	}
+
+	auditLogger.Log(cred.UserID, "passkey_login", "passkey", r.RemoteAddr, map[string]interface{}{
+		"credential_id": cred.ID,
+		"second_factor": ceremony.MFAToken != "",
+	})
+
+	token, err := issueTokens(r, Grant{
+		UserID:   cred.UserID,
+		AuthTime: time.Now(),
+		AMR:      amr,
+	})
+	if err != nil {
+		writeIssueTokenError(w, err)
+		return
+	}
+
+	var trustedDeviceToken string
+	if ceremony.RememberDevice {
+		trustedDeviceToken = issueTrustedDevice(r, cred.UserID)
+	}
+	writeSignInResponse(w, token, trustedDeviceToken, wantsCookieTransport(r))
+}
+
+// verifyPasskeyAssertion checks a login response against its ceremony and
+// the stored credential (WebAuthn section 7.2).
+func verifyPasskeyAssertion(req *credentialResponse) (*WebAuthnCredential, *webauthnCeremony, error) {
+	clientDataJSON, err := decodeBase64URL(req.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, errInvalidClientData
+	}
+	clientData, err := parseClientData(clientDataJSON)
+	if err != nil {
+		return nil, nil, err
+	}
+	ceremony, ok := takeCeremony(clientData.Challenge, false)
+	if !ok {
+		return nil, nil, errInvalidClientData
+	}
+	if err := relyingParty.verifyClientData(clientData, "webauthn.get", ceremony.Challenge); err != nil {
+		return nil, nil, err
+	}
+
+	rawID, err := decodeBase64URL(req.RawID)
+	if err != nil {
+		return nil, nil, errInvalidSignature
+	}
+	cred, exists := passkeyStore.Get(base64.RawURLEncoding.EncodeToString(rawID))
+	if !exists {
+		return nil, nil, errInvalidSignature
+	}
+	if ceremony.UserID != "" && cred.UserID != ceremony.UserID {
+		return nil, nil, errInvalidSignature
+	}
+	if req.Response.UserHandle != "" {
+		userHandle, err := decodeBase64URL(req.Response.UserHandle)
+		if err != nil || string(userHandle) != cred.UserID {
+			return nil, nil, errInvalidSignature
+		}
+	}
+
+	rawAuthData, err := decodeBase64URL(req.Response.AuthenticatorData)
+	if err != nil {
+		return nil, nil, errInvalidAuthData
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := relyingParty.verifyAuthenticatorData(authData, ceremony.RequireUV); err != nil {
+		return nil, nil, err
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(cred.PublicKey)
+	if err != nil {
+		return nil, nil, errUnsupportedKey
+	}
+	sig, err := decodeBase64URL(req.Response.Signature)
+	if err != nil {
+		return nil, nil, errInvalidSignature
+	}
+	if err := verifyAssertionSignature(pub, cred.Algorithm, rawAuthData, clientDataJSON, sig); err != nil {
+		return nil, nil, err
+	}
+
+	if err := passkeyStore.RecordUse(cred.ID, authData.SignCount); err != nil {
+		auditLogger.Log(cred.UserID, "passkey_sign_count_mismatch", "passkey", "", map[string]interface{}{
+			"credential_id": cred.ID,
+		})
+		return nil, nil, err
+	}
+	return &cred, ceremony, nil
+}
+
+// PasskeyInfo is what a user sees about their own passkeys.
+type PasskeyInfo struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	AAGUID     string     `json:"aaguid"`
+	Transports []string   `json:"transports,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func newPasskeyInfo(cred *WebAuthnCredential) PasskeyInfo {
+	info := PasskeyInfo{
+		ID:         cred.ID,
+		Name:       cred.Name,
+		AAGUID:     cred.AAGUID,
+		Transports: cred.Transports,
+		CreatedAt:  cred.CreatedAt,
+	}
+	if !cred.LastUsedAt.IsZero() {
+		lastUsed := cred.LastUsedAt
+		info.LastUsedAt = &lastUsed
+	}
+	return info
+}
+
+// passkeysHandler lists (GET) or removes (DELETE) the caller's passkeys.
+func passkeysHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromRequest(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		passkeys := []PasskeyInfo{}
+		for _, cred := range passkeyStore.ListByUser(claims.Subject) {
+			passkeys = append(passkeys, newPasskeyInfo(&cred))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"passkeys": passkeys,
+		})
+	case http.MethodDelete:
+		var req struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !checkStepUp(w, r) {
+			return
+		}
+		if !passkeyStore.Delete(claims.Subject, req.ID) {
+			http.Error(w, "Passkey not found", http.StatusNotFound)
+			return
+		}
+		auditLogger.Log(claims.Subject, "passkey_removed", "passkey", r.RemoteAddr, map[string]interface{}{
+			"credential_id": req.ID,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Passkey removed",
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func formatAAGUID(b []byte) string {
+	if len(b) != 16 {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
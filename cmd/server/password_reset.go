@@ -3,7 +3,10 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"sync"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 type PasswordResetToken struct {
@@ -12,7 +15,52 @@ type PasswordResetToken struct {
 	ExpiresAt time.Time
 }
 
-var resetTokens = make(map[string]*PasswordResetToken)
+// ResetTokenStore is the in-memory ResetTokenRepository.
+type ResetTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*PasswordResetToken
+}
+
+var resetTokens ResetTokenRepository = &ResetTokenStore{
+	tokens: make(map[string]*PasswordResetToken),
+}
+
+func (rs *ResetTokenStore) Create(token *PasswordResetToken) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	t := *token
+	rs.tokens[token.Token] = &t
+	return nil
+}
+
+func (rs *ResetTokenStore) Consume(token string) (*PasswordResetToken, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	resetToken, exists := rs.tokens[token]
+	if !exists {
+		return nil, false
+	}
+	delete(rs.tokens, token)
+	if time.Now().After(resetToken.ExpiresAt) {
+		return nil, false
+	}
+	return resetToken, true
+}
+
+func (rs *ResetTokenStore) DeleteExpired(now time.Time) int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	evicted := 0
+	for token, resetToken := range rs.tokens {
+		if now.After(resetToken.ExpiresAt) {
+			delete(rs.tokens, token)
+			evicted++
+		}
+	}
+	return evicted
+}
 
 func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -29,9 +77,7 @@ func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	store.mu.RLock()
-	user, exists := store.users[req.Email]
-	store.mu.RUnlock()
+	user, exists := store.GetByEmail(req.Email)
 
 	if !exists {
 		// Don't reveal if user exists for security
@@ -44,10 +90,14 @@ func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Generate reset token
 	resetToken := generateToken()
-	resetTokens[resetToken] = &PasswordResetToken{
+	err := resetTokens.Create(&PasswordResetToken{
 		Token:     resetToken,
 		UserID:    user.ID,
 		ExpiresAt: time.Now().Add(1 * time.Hour),
+	})
+	if err != nil {
+		http.Error(w, "Failed to create reset token", http.StatusInternalServerError)
+		return
 	}
 
 	// In production, send email with reset link
@@ -74,30 +124,32 @@ func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resetToken, exists := resetTokens[req.Token]
-	if !exists || time.Now().After(resetToken.ExpiresAt) {
-		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+	// Check the password first so a weak one doesn't use up the token
+	if !validatePassword(req.NewPassword) {
+		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
 		return
 	}
 
-	if !validatePassword(req.NewPassword) {
-		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+	resetToken, exists := resetTokens.Consume(req.Token)
+	if !exists {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
 		return
 	}
 
 	// Find user and update password
-	store.mu.Lock()
-	for _, user := range store.users {
-		if user.ID == resetToken.UserID {
-			hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
-			user.PasswordHash = string(hashedPassword)
-			break
-		}
+	user, exists := store.GetByID(resetToken.UserID)
+	if !exists {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
 	}
-	store.mu.Unlock()
-
-	// Delete used token
-	delete(resetTokens, req.Token)
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	user.PasswordHash = string(hashedPassword)
+	if err := store.Update(user); err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	// Proving control of the mailbox is as good as the unlock link
+	clearLoginFailures(user.Email)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
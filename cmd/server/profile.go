@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 	"strings"
 )
@@ -17,45 +18,74 @@ func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Authorization header required", http.StatusUnauthorized)
+	claims, _ := claimsFromRequest(r)
+
+	var req UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	req.Email = strings.TrimSpace(req.Email)
 
-	token := strings.TrimPrefix(authHeader, "Bearer ")
-	session, exists := sessionStore.Get(token)
-	if !exists {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	if req.Email != "" && !validateEmail(req.Email) {
+		http.Error(w, "Invalid email format", http.StatusBadRequest)
 		return
 	}
 
-	var req UpdateProfileRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	// Changing the email changes where password resets and sign-in links go
+	if req.Email != "" && !checkStepUp(w, r) {
 		return
 	}
 
-	users.mu.Lock()
-	user, exists := users.users[session.UserID]
+	user, exists := store.GetByID(claims.Subject)
 	if !exists {
-		users.mu.Unlock()
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
+	previousEmail := user.Email
+	emailChanged := req.Email != "" && normalizeEmail(req.Email) != normalizeEmail(user.Email)
 	if req.Email != "" {
 		user.Email = req.Email
 	}
+	if emailChanged {
+		user.EmailVerified = false
+	}
 	if req.FullName != "" {
-		user.FullName = req.FullName
+		user.Name = req.FullName
 	}
 
-	users.mu.Unlock()
+	if err := store.Update(user); err == errUserExists {
+		http.Error(w, "Email already in use", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+		return
+	}
+
+	if emailChanged {
+		auditLogger.Log(user.ID, "email_changed", "user", r.RemoteAddr, map[string]interface{}{
+			"previous_email": previousEmail,
+		})
+		sendEmailVerification(user)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
 
-
-
+// sendEmailVerification mails a verification token to the user's new
+// address.
+func sendEmailVerification(user *User) {
+	token, err := generateVerificationToken(user.Email, user.ID)
+	if err != nil {
+		log.Printf("Failed to create verification token: %v", err)
+		return
+	}
+	body := "Confirm your new email address with this token:\n\n" + token
+	go func() {
+		if err := mailer.Send(user.Email, "Verify your email address", body); err != nil {
+			log.Printf("Failed to send verification email: %v", err)
+		}
+	}()
+}
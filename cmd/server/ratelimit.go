@@ -1,64 +1,152 @@
 package main
 
 import (
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
 
+// RateLimit allows Requests per Period, all of which may come in a burst.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// Per-route limits. Each route wrapped by rateLimitMiddleware counts
+// separately, so a client registering doesn't use up its login attempts.
+var (
+	authRateLimit     = RateLimit{Requests: 10, Period: time.Minute}
+	registerRateLimit = RateLimit{Requests: 5, Period: 10 * time.Minute}
+	// Endpoints that send email
+	emailRateLimit = RateLimit{Requests: 5, Period: 15 * time.Minute}
+	// Browser pages that post their own forms back
+	pageRateLimit = RateLimit{Requests: 30, Period: time.Minute}
+)
+
+// RateLimiter implements the generic cell rate algorithm: for each key it
+// keeps only the theoretical arrival time (TAT) of the next request, which
+// moves forward by Period/Requests for every request allowed. A request
+// is refused while the TAT is more than a Period ahead of now.
 type RateLimiter struct {
 	mu       sync.Mutex
-	requests map[string][]time.Time
-	limit    int
-	window   time.Duration
+	limit    RateLimit
+	interval time.Duration
+	tat      map[string]time.Time
 }
 
-var rateLimiter = &RateLimiter{
-	requests: make(map[string][]time.Time),
-	limit:    10,
-	window:   time.Minute,
+// RateLimitResult describes one Allow decision, for the RateLimit headers.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // until the full burst is available again
+	RetryAfter time.Duration // until the next request will be allowed
+}
+
+var rateLimiters = struct {
+	mu   sync.Mutex
+	list []*RateLimiter
+}{}
+
+// NewRateLimiter creates a limiter that the janitor sweeps for idle keys.
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	rl := &RateLimiter{
+		limit:    limit,
+		interval: limit.Period / time.Duration(limit.Requests),
+		tat:      make(map[string]time.Time),
+	}
+	rateLimiters.mu.Lock()
+	rateLimiters.list = append(rateLimiters.list, rl)
+	rateLimiters.mu.Unlock()
+	return rl
 }
 
-func (rl *RateLimiter) Allow(ip string) bool {
+func (rl *RateLimiter) Allow(key string, now time.Time) RateLimitResult {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
-	cutoff := now.Add(-rl.window)
+	tat := rl.tat[key]
+	if tat.Before(now) {
+		tat = now
+	}
+	newTAT := tat.Add(rl.interval)
+	result := RateLimitResult{Limit: rl.limit.Requests}
+
+	if allowAt := newTAT.Add(-rl.limit.Period); now.Before(allowAt) {
+		result.RetryAfter = allowAt.Sub(now)
+		result.Reset = tat.Sub(now)
+		return result
+	}
+
+	rl.tat[key] = newTAT
+	result.Allowed = true
+	result.Reset = newTAT.Sub(now)
+	result.Remaining = int((rl.limit.Period - result.Reset) / rl.interval)
+	return result
+}
+
+// DeleteIdle forgets keys whose bucket has refilled completely; they would
+// behave exactly like a key never seen before.
+func (rl *RateLimiter) DeleteIdle(now time.Time) int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
 
-	// Clean old requests
-	if times, exists := rl.requests[ip]; exists {
-		validTimes := []time.Time{}
-		for _, t := range times {
-			if t.After(cutoff) {
-				validTimes = append(validTimes, t)
-			}
+	n := 0
+	for key, tat := range rl.tat {
+		if !tat.After(now) {
+			delete(rl.tat, key)
+			n++
 		}
-		rl.requests[ip] = validTimes
 	}
+	return n
+}
+
+// sweepRateLimiters evicts idle keys from every limiter.
+func sweepRateLimiters(now time.Time) int {
+	rateLimiters.mu.Lock()
+	defer rateLimiters.mu.Unlock()
+
+	n := 0
+	for _, rl := range rateLimiters.list {
+		n += rl.DeleteIdle(now)
+	}
+	return n
+}
 
-	// Check limit
-	if len(rl.requests[ip]) >= rl.limit {
-		return false
+// clientIP is the address requests are limited by. RemoteAddr carries the
+// port too, which changes with every connection.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
+	return host
+}
 
-	// Record request
-	rl.requests[ip] = append(rl.requests[ip], now)
-	return true
+// ceilSeconds rounds up, so clients that wait the advertised time are let in.
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
 }
 
-func rateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// rateLimitMiddleware limits each client IP to limit on this route and
+// reports the client's quota in RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers.
+func rateLimitMiddleware(limit RateLimit, next http.HandlerFunc) http.HandlerFunc {
+	limiter := NewRateLimiter(limit)
 	return func(w http.ResponseWriter, r *http.Request) {
-		ip := r.RemoteAddr
-		if !rateLimiter.Allow(ip) {
+		result := limiter.Allow(clientIP(r), time.Now())
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", ceilSeconds(result.Reset))
+		if !result.Allowed {
+			w.Header().Set("Retry-After", ceilSeconds(result.RetryAfter))
 			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 			return
 		}
 		next(w, r)
 	}
 }
-
-
-
-
-
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurstAndSteadyRate(t *testing.T) {
+	rl := NewRateLimiter(RateLimit{Requests: 5, Period: 10 * time.Second})
+	t0 := time.Unix(1700000000, 0)
+
+	// The full allowance is available at once
+	for i := 0; i < 5; i++ {
+		got := rl.Allow("ip", t0)
+		want := RateLimitResult{Allowed: true, Limit: 5, Remaining: 4 - i, Reset: time.Duration(i+1) * 2 * time.Second}
+		if got != want {
+			t.Fatalf("burst request %d: got %+v, want %+v", i+1, got, want)
+		}
+	}
+	got := rl.Allow("ip", t0)
+	want := RateLimitResult{Limit: 5, Reset: 10 * time.Second, RetryAfter: 2 * time.Second}
+	if got != want {
+		t.Fatalf("over the burst: got %+v, want %+v", got, want)
+	}
+
+	// Then one request per Period/Requests
+	now := t0
+	for i := 0; i < 10; i++ {
+		now = now.Add(2 * time.Second)
+		if got := rl.Allow("ip", now); !got.Allowed || got.Remaining != 0 {
+			t.Fatalf("steady request %d: got %+v", i+1, got)
+		}
+		if got := rl.Allow("ip", now.Add(time.Second)); got.Allowed || got.RetryAfter != time.Second {
+			t.Fatalf("early request %d: got %+v", i+1, got)
+		}
+	}
+
+	// Keys are independent
+	if got := rl.Allow("other", now); !got.Allowed || got.Remaining != 4 {
+		t.Errorf("other key: got %+v", got)
+	}
+
+	// A full Period of quiet restores the burst, and the key can be dropped
+	now = now.Add(10 * time.Second)
+	if n := rl.DeleteIdle(now); n != 2 {
+		t.Errorf("DeleteIdle evicted %d keys, want 2", n)
+	}
+	if got := rl.Allow("ip", now); !got.Allowed || got.Remaining != 4 {
+		t.Errorf("after idling: got %+v", got)
+	}
+}
+
+func TestRateLimitMiddlewareHeaders(t *testing.T) {
+	handler := rateLimitMiddleware(RateLimit{Requests: 2, Period: time.Minute}, func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, want := range []struct {
+		code       int
+		remaining  string
+		reset      string
+		retryAfter string
+	}{
+		{http.StatusOK, "1", "30", ""},
+		{http.StatusOK, "0", "60", ""},
+		{http.StatusTooManyRequests, "0", "60", "30"},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != want.code {
+			t.Fatalf("got status %d, want %d", w.Code, want.code)
+		}
+		for header, value := range map[string]string{
+			"RateLimit-Limit":     "2",
+			"RateLimit-Remaining": want.remaining,
+			"RateLimit-Reset":     want.reset,
+			"Retry-After":         want.retryAfter,
+		} {
+			if got := w.Header().Get(header); got != value {
+				t.Errorf("status %d: %s is %q, want %q", want.code, header, got, value)
+			}
+		}
+	}
+
+	// The limit is per IP, not per connection
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+	r.RemoteAddr = "192.0.2.1:5678"
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("new port from the same IP: got %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
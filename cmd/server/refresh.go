@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
+	"time"
 )
 
 func refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -15,37 +17,87 @@ func refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
 		RefreshToken string `json:"refresh_token"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	// Cookie clients may send no body at all
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	userID, valid := refreshTokens.Validate(req.RefreshToken)
-	if !valid {
+	fromCookie := false
+	if req.RefreshToken == "" {
+		if cookie, err := r.Cookie(refreshCookieName()); err == nil {
+			if !checkCSRF(r) {
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+			req.RefreshToken = cookie.Value
+			fromCookie = true
+		}
+	}
+
+	// Only first-party tokens are accepted here; client tokens go through
+	// /oauth/token with client authentication
+	info, err := rotateRefreshToken(r, req.RefreshToken, "")
+	if err != nil {
 		http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
 		return
 	}
 
-	// Generate new tokens
-	newAccessToken := generateToken()
-	newRefreshToken := generateToken()
-
-	// Store new refresh token
-	refreshTokens.Store(newRefreshToken, userID, 7*24*time.Hour)
-
-	// Revoke old refresh token
-	refreshTokens.Revoke(req.RefreshToken)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(Token{
-		AccessToken:  newAccessToken,
-		RefreshToken: newRefreshToken,
-		TokenType:    "Bearer",
-		ExpiresIn:    3600,
+	// The successor stays in the same family so a replay of the old token
+	// can take the whole chain down
+	token, err := issueTokens(r, Grant{
+		UserID:   info.UserID,
+		FamilyID: info.FamilyID,
+		Refresh:  true,
+		AuthTime: info.AuthTime,
+		AMR:      info.AMR,
 	})
-}
-
-
+	if err != nil {
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
 
+	writeSignInResponse(w, token, "", fromCookie || wantsCookieTransport(r))
+}
 
+// rotateRefreshToken consumes a refresh token issued to clientID. A replayed
+// token was either stolen or leaked, so its whole family is revoked before
+// the error is returned. So is a family whose sign-in has gone idle or
+// outlived its SessionPolicy.
+func rotateRefreshToken(r *http.Request, token, clientID string) (*TokenInfo, error) {
+	info, err := refreshTokens.Rotate(token, clientID)
+	if err == errRefreshTokenReused {
+		revoked := revokeFamily(info.UserID, info.FamilyID)
+		auditLogger.Log(info.UserID, "refresh_token_reuse", "refresh_token", r.RemoteAddr, map[string]interface{}{
+			"family_id":        info.FamilyID,
+			"revoked_sessions": revoked,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSignInActive(info, time.Now()); err != nil {
+		revokeFamily(info.UserID, info.FamilyID)
+		return nil, err
+	}
+	return info, nil
+}
 
+// revokeFamily revokes every refresh token in the user's family and deletes
+// the sessions issued alongside them, returning how many sessions were
+// deleted. The family only links its newest session; the earlier ones
+// are found by the family's session ID.
+func revokeFamily(userID, familyID string) int {
+	deleted := make(map[string]bool)
+	for _, token := range refreshTokens.RevokeFamily(familyID) {
+		sessionStore.Delete(token)
+		deleted[token] = true
+	}
+	for _, session := range sessionStore.GetUserSessions(userID) {
+		if session.ID == familyID {
+			sessionStore.Delete(session.Token)
+			deleted[session.Token] = true
+		}
+	}
+	return len(deleted)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+)
+
+// revokeHandler implements RFC 7009. Unknown, expired or foreign tokens are
+// not an error: the client only learns that the token is no longer usable.
+func revokeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid form body")
+		return
+	}
+
+	client, ok := identifyClient(r)
+	if !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	if r.PostForm.Get("token_type_hint") == "refresh_token" {
+		if !revokeRefreshToken(client, token) {
+			revokeAccessToken(client, token)
+		}
+	} else {
+		if !revokeAccessToken(client, token) {
+			revokeRefreshToken(client, token)
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// revokeAccessToken deletes the session behind an access token if it was
+// issued to client or to a first-party login.
+func revokeAccessToken(client *OAuthClient, token string) bool {
+	claims, ok := activeAccessToken(token)
+	if !ok {
+		return false
+	}
+	if claims.ClientID != "" && claims.ClientID != client.ID {
+		return false
+	}
+
+	sessionStore.Delete(token)
+	return true
+}
+
+// revokeRefreshToken revokes the token's whole family, since the access
+// tokens issued from the same grant should stop working too.
+func revokeRefreshToken(client *OAuthClient, token string) bool {
+	info, exists := refreshTokens.Get(token)
+	if !exists {
+		return false
+	}
+	if info.ClientID != "" && info.ClientID != client.ID {
+		return false
+	}
+
+	revokeFamily(info.UserID, info.FamilyID)
+	return true
+}
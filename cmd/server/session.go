@@ -1,40 +1,60 @@
 package main
 
 import (
+	"context"
+	"net/http"
 	"sync"
 	"time"
 )
 
 type Session struct {
-	UserID    string
-	Token     string
+	// ID names the sign-in rather than the access token: every token
+	// refreshed from the same login shares it (it is the refresh token
+	// family ID), so users see and revoke one entry per device
+	ID       string
+	UserID   string
+	ClientID string
+	Token    string
+	// ExpiresAt slides forward as the session is used, within the limits
+	// of its SessionPolicy
 	CreatedAt time.Time
 	ExpiresAt time.Time
-	IPAddress string
-	UserAgent string
+	// LastSeenAt is updated by authMiddleware, at most once per
+	// sessionTouchInterval
+	LastSeenAt time.Time
+	IPAddress  string
+	UserAgent  string
+	// AuthTime is when the user last proved who they are and AMR how
+	// (RFC 8176 values); refreshed tokens carry both forward
+	AuthTime time.Time
+	AMR      []string
+	// Exchanged sessions belong to tokens minted by token exchange. They
+	// are kept so the tokens can be revoked with the user's other sessions,
+	// but aren't listed to the user or counted against the session limit.
+	Exchanged bool
 }
 
+// sessionTouchInterval bounds how often a session's LastSeenAt is written,
+// so busy clients don't turn every request into a store write.
+const sessionTouchInterval = time.Minute
+
+// SessionStore is the in-memory SessionRepository.
 type SessionStore struct {
 	mu       sync.RWMutex
 	sessions map[string]*Session
 }
 
-var sessionStore = &SessionStore{
+var sessionStore SessionRepository = &SessionStore{
 	sessions: make(map[string]*Session),
 }
 
-func (ss *SessionStore) Create(userID, token, ip, userAgent string) {
+func (ss *SessionStore) Create(session *Session) error {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
 
-	ss.sessions[token] = &Session{
-		UserID:    userID,
-		Token:     token,
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(24 * time.Hour),
-		IPAddress: ip,
-		UserAgent: userAgent,
-	}
+	s := *session
+	ss.sessions[session.Token] = &s
+	return nil
 }
 
 func (ss *SessionStore) Get(token string) (*Session, bool) {
@@ -45,7 +65,8 @@ func (ss *SessionStore) Get(token string) (*Session, bool) {
 	if !exists || time.Now().After(session.ExpiresAt) {
 		return nil, false
 	}
-	return session, true
+	s := *session
+	return &s, true
 }
 
 func (ss *SessionStore) Delete(token string) {
@@ -54,6 +75,15 @@ func (ss *SessionStore) Delete(token string) {
 	delete(ss.sessions, token)
 }
 
+func (ss *SessionStore) Touch(token string, lastSeen, expiresAt time.Time) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if session, exists := ss.sessions[token]; exists {
+		session.LastSeenAt = lastSeen
+		session.ExpiresAt = expiresAt
+	}
+}
+
 func (ss *SessionStore) GetUserSessions(userID string) []*Session {
 	ss.mu.RLock()
 	defer ss.mu.RUnlock()
@@ -61,12 +91,35 @@ func (ss *SessionStore) GetUserSessions(userID string) []*Session {
 	sessions := []*Session{}
 	for _, session := range ss.sessions {
 		if session.UserID == userID && time.Now().Before(session.ExpiresAt) {
-			sessions = append(sessions, session)
+			s := *session
+			sessions = append(sessions, &s)
 		}
 	}
 	return sessions
 }
 
+func (ss *SessionStore) DeleteExpired(now time.Time) int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
 
+	evicted := 0
+	for token, session := range ss.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(ss.sessions, token)
+			evicted++
+		}
+	}
+	return evicted
+}
 
+const sessionContextKey contextKey = "session"
 
+func withSession(r *http.Request, session *Session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionContextKey, session))
+}
+
+// sessionFromRequest returns the session authMiddleware attached to the request.
+func sessionFromRequest(r *http.Request) (*Session, bool) {
+	session, ok := r.Context().Value(sessionContextKey).(*Session)
+	return session, ok
+}
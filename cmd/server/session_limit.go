@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+var errSessionLimitReached = errors.New("maximum number of active sessions reached")
+
+// What to do when a sign-in would take a user past the session limit.
+const (
+	sessionLimitEvictOldest = "evict_oldest"
+	sessionLimitReject      = "reject"
+)
+
+// sessionLimit caps how many sessions (sign-ins, as listed by
+// /api/users/me/sessions) a user may have at once. Max 0 means no limit.
+// mu serializes new sign-ins so concurrent logins can't both slip under
+// the cap.
+var sessionLimit = struct {
+	mu     sync.Mutex
+	Max    int
+	Action string
+}{
+	Action: sessionLimitEvictOldest,
+}
+
+// loadSessionLimitFromEnv reads MAX_SESSIONS_PER_USER and
+// SESSION_LIMIT_ACTION.
+func loadSessionLimitFromEnv() error {
+	max, err := strconv.Atoi(getEnv("MAX_SESSIONS_PER_USER", "0"))
+	if err != nil || max < 0 {
+		return fmt.Errorf("invalid MAX_SESSIONS_PER_USER %q", getEnv("MAX_SESSIONS_PER_USER", "0"))
+	}
+	action := getEnv("SESSION_LIMIT_ACTION", sessionLimitEvictOldest)
+	if action != sessionLimitEvictOldest && action != sessionLimitReject {
+		return fmt.Errorf("invalid SESSION_LIMIT_ACTION %q: want %s or %s", action, sessionLimitEvictOldest, sessionLimitReject)
+	}
+	sessionLimit.Max = max
+	sessionLimit.Action = action
+	return nil
+}
+
+// enforceSessionLimit makes room for one more session for userID, evicting
+// the oldest sessions or refusing with errSessionLimitReached. The caller
+// must hold sessionLimit.mu until the new session is stored.
+func enforceSessionLimit(r *http.Request, userID string) error {
+	sessions := listUserSessions(userID, "")
+	if len(sessions) < sessionLimit.Max {
+		return nil
+	}
+	if sessionLimit.Action == sessionLimitReject {
+		auditLogger.Log(userID, "session_limit_reached", "session", r.RemoteAddr, map[string]interface{}{
+			"active_sessions": len(sessions),
+			"limit":           sessionLimit.Max,
+		})
+		return errSessionLimitReached
+	}
+
+	// Oldest sign-in first
+	for len(sessions) >= sessionLimit.Max {
+		oldest := 0
+		for i := range sessions {
+			if sessions[i].CreatedAt.Before(sessions[oldest].CreatedAt) {
+				oldest = i
+			}
+		}
+		evicted := sessions[oldest]
+		revokeSession(userID, evicted.ID)
+		auditLogger.Log(userID, "session_evicted", "session", r.RemoteAddr, map[string]interface{}{
+			"session_id": evicted.ID,
+			"signed_in":  evicted.CreatedAt,
+			"ip_address": evicted.IPAddress,
+			"user_agent": evicted.UserAgent,
+			"reason":     "session_limit",
+			"limit":      sessionLimit.Max,
+		})
+		sessions = append(sessions[:oldest], sessions[oldest+1:]...)
+	}
+	return nil
+}
+
+// writeIssueTokenError answers a first-party sign-in whose tokens could
+// not be issued.
+func writeIssueTokenError(w http.ResponseWriter, err error) {
+	if err == errSessionLimitReached {
+		http.Error(w, "Maximum number of active sessions reached; sign out of another session first", http.StatusConflict)
+		return
+	}
+	http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var errSessionExpired = errors.New("session expired")
+
+// SessionPolicy limits how long a sign-in lasts. It ends IdleTimeout after
+// it was last used, and MaxLifetime after the user authenticated, however
+// active it is.
+type SessionPolicy struct {
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+}
+
+// Client types that get their own session policy. First-party sessions are
+// the ones this API issues directly, without an OAuth client.
+const (
+	clientTypeFirstParty   = "first_party"
+	clientTypePublic       = "public_client"
+	clientTypeConfidential = "confidential_client"
+)
+
+var sessionPolicies = map[string]SessionPolicy{
+	clientTypeFirstParty:   {IdleTimeout: 24 * time.Hour, MaxLifetime: 7 * 24 * time.Hour},
+	clientTypePublic:       {IdleTimeout: 24 * time.Hour, MaxLifetime: 7 * 24 * time.Hour},
+	clientTypeConfidential: {IdleTimeout: 24 * time.Hour, MaxLifetime: 7 * 24 * time.Hour},
+}
+
+// loadSessionPoliciesFromEnv reads SESSION_POLICY_FIRST_PARTY,
+// SESSION_POLICY_PUBLIC_CLIENT and SESSION_POLICY_CONFIDENTIAL_CLIENT, each
+// an idle timeout and a maximum lifetime such as "30m,12h".
+func loadSessionPoliciesFromEnv() error {
+	for clientType := range sessionPolicies {
+		name := "SESSION_POLICY_" + strings.ToUpper(clientType)
+		value := getEnv(name, "")
+		if value == "" {
+			continue
+		}
+		idle, max, ok := strings.Cut(value, ",")
+		policy := SessionPolicy{}
+		var err error
+		if ok {
+			policy.IdleTimeout, err = time.ParseDuration(strings.TrimSpace(idle))
+		}
+		if ok && err == nil {
+			policy.MaxLifetime, err = time.ParseDuration(strings.TrimSpace(max))
+		}
+		if !ok || err != nil || policy.IdleTimeout <= 0 || policy.MaxLifetime < policy.IdleTimeout {
+			return fmt.Errorf("invalid %s %q: want an idle timeout and a longer maximum lifetime, e.g. \"30m,12h\"", name, value)
+		}
+		sessionPolicies[clientType] = policy
+	}
+	return nil
+}
+
+// touchInterval is how stale LastSeenAt may get before authMiddleware
+// writes it. Short idle timeouts need more frequent writes than
+// sessionTouchInterval, or sessions in use would lapse between them.
+func (p SessionPolicy) touchInterval() time.Duration {
+	if p.IdleTimeout/10 < sessionTouchInterval {
+		return p.IdleTimeout / 10
+	}
+	return sessionTouchInterval
+}
+
+// sessionPolicyFor returns the policy for sessions issued to clientID.
+func sessionPolicyFor(clientID string) SessionPolicy {
+	if clientID == "" {
+		return sessionPolicies[clientTypeFirstParty]
+	}
+	if client, exists := clientStore.Get(clientID); exists && client.Public {
+		return sessionPolicies[clientTypePublic]
+	}
+	return sessionPolicies[clientTypeConfidential]
+}
+
+// sessionStart is when a session's maximum lifetime began: when the user
+// authenticated, which refreshing carries forward, or for client tokens
+// when the session was created.
+func sessionStart(session *Session) time.Time {
+	if !session.AuthTime.IsZero() {
+		return session.AuthTime
+	}
+	return session.CreatedAt
+}
+
+// sessionExpiry is when session lapses if it isn't used again after
+// lastSeen.
+func sessionExpiry(session *Session, lastSeen time.Time) time.Time {
+	policy := sessionPolicyFor(session.ClientID)
+	idle := lastSeen.Add(policy.IdleTimeout)
+	absolute := sessionStart(session).Add(policy.MaxLifetime)
+	if absolute.Before(idle) {
+		return absolute
+	}
+	return idle
+}
+
+// checkSignInActive reports whether the sign-in a refresh token belongs to
+// may still be extended: within its maximum lifetime, and used recently
+// enough by one of its access tokens.
+func checkSignInActive(info *TokenInfo, now time.Time) error {
+	policy := sessionPolicyFor(info.ClientID)
+	if !info.AuthTime.IsZero() && now.Sub(info.AuthTime) > policy.MaxLifetime {
+		return errSessionExpired
+	}
+
+	var lastSeen time.Time
+	for _, session := range sessionStore.GetUserSessions(info.UserID) {
+		if session.ID == info.FamilyID && session.LastSeenAt.After(lastSeen) {
+			lastSeen = session.LastSeenAt
+		}
+	}
+	if now.Sub(lastSeen) > policy.IdleTimeout {
+		return errSessionExpired
+	}
+	return nil
+}
@@ -0,0 +1,925 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// openSQLite opens the database at path and brings its schema up to date.
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection avoids SQLITE_BUSY
+	// between our own transactions
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrate applies migrations/*.sql in name order, recording each in
+// schema_migrations so it only runs once.
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    TEXT PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		version := strings.TrimSuffix(strings.TrimPrefix(name, "migrations/"), ".sql")
+		var applied int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`, version).Scan(&applied); err != nil {
+			return err
+		}
+		if applied > 0 {
+			continue
+		}
+
+		script, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(script)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, toMillis(time.Now())); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Applied migration %s", version)
+	}
+	return nil
+}
+
+func toMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func fromMillis(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+func joinAMR(amr []string) string {
+	return strings.Join(amr, " ")
+}
+
+func splitAMR(amr string) []string {
+	return strings.Fields(amr)
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+type sqlUserStore struct {
+	db *sql.DB
+}
+
+const userColumns = `id, email, password_hash, name, email_verified, created_at`
+
+func scanUser(row rowScanner) (*User, error) {
+	var user User
+	var createdAt int64
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Name, &user.EmailVerified, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	user.CreatedAt = fromMillis(createdAt)
+	return &user, nil
+}
+
+func (s *sqlUserStore) Create(user *User) error {
+	_, err := s.db.Exec(`INSERT INTO users (`+userColumns+`, email_normalized) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		user.ID, user.Email, user.PasswordHash, user.Name, user.EmailVerified, toMillis(user.CreatedAt),
+		normalizeEmail(user.Email))
+	if isUniqueViolation(err) {
+		return errUserExists
+	}
+	return err
+}
+
+func (s *sqlUserStore) get(query string, arg string) (*User, bool) {
+	user, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE `+query, arg))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to load user: %v", err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+func (s *sqlUserStore) GetByID(id string) (*User, bool) {
+	return s.get(`id = ?`, id)
+}
+
+func (s *sqlUserStore) GetByEmail(email string) (*User, bool) {
+	return s.get(`email_normalized = ?`, normalizeEmail(email))
+}
+
+func (s *sqlUserStore) Update(user *User) error {
+	res, err := s.db.Exec(`UPDATE users SET email = ?, email_normalized = ?, password_hash = ?, name = ?, email_verified = ? WHERE id = ?`,
+		user.Email, normalizeEmail(user.Email), user.PasswordHash, user.Name, user.EmailVerified, user.ID)
+	if isUniqueViolation(err) {
+		return errUserExists
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+type sqlSessionStore struct {
+	db *sql.DB
+}
+
+const sessionColumns = `token, id, user_id, client_id, created_at, expires_at, last_seen_at, ip_address, user_agent, auth_time, amr, exchanged`
+
+func scanSession(row rowScanner) (*Session, error) {
+	var session Session
+	var createdAt, expiresAt, lastSeenAt, authTime int64
+	var amr string
+	err := row.Scan(&session.Token, &session.ID, &session.UserID, &session.ClientID, &createdAt, &expiresAt, &lastSeenAt,
+		&session.IPAddress, &session.UserAgent, &authTime, &amr, &session.Exchanged)
+	if err != nil {
+		return nil, err
+	}
+	session.CreatedAt = fromMillis(createdAt)
+	session.ExpiresAt = fromMillis(expiresAt)
+	session.LastSeenAt = fromMillis(lastSeenAt)
+	session.AuthTime = fromMillis(authTime)
+	session.AMR = splitAMR(amr)
+	return &session, nil
+}
+
+func (s *sqlSessionStore) Create(session *Session) error {
+	_, err := s.db.Exec(`INSERT INTO sessions (`+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.Token, session.ID, session.UserID, session.ClientID, toMillis(session.CreatedAt), toMillis(session.ExpiresAt),
+		toMillis(session.LastSeenAt), session.IPAddress, session.UserAgent, toMillis(session.AuthTime), joinAMR(session.AMR), session.Exchanged)
+	return err
+}
+
+func (s *sqlSessionStore) Get(token string) (*Session, bool) {
+	session, err := scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE token = ? AND expires_at > ?`,
+		token, toMillis(time.Now())))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to load session: %v", err)
+		}
+		return nil, false
+	}
+	return session, true
+}
+
+func (s *sqlSessionStore) Delete(token string) {
+	if _, err := s.db.Exec(`DELETE FROM sessions WHERE token = ?`, token); err != nil {
+		log.Printf("Failed to delete session: %v", err)
+	}
+}
+
+func (s *sqlSessionStore) Touch(token string, lastSeen, expiresAt time.Time) {
+	_, err := s.db.Exec(`UPDATE sessions SET last_seen_at = ?, expires_at = ? WHERE token = ?`,
+		toMillis(lastSeen), toMillis(expiresAt), token)
+	if err != nil {
+		log.Printf("Failed to update session: %v", err)
+	}
+}
+
+func (s *sqlSessionStore) GetUserSessions(userID string) []*Session {
+	rows, err := s.db.Query(`SELECT `+sessionColumns+` FROM sessions WHERE user_id = ? AND expires_at > ?`,
+		userID, toMillis(time.Now()))
+	if err != nil {
+		log.Printf("Failed to list sessions: %v", err)
+		return []*Session{}
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			log.Printf("Failed to list sessions: %v", err)
+			return []*Session{}
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func (s *sqlSessionStore) DeleteExpired(now time.Time) int {
+	return deleteExpired(s.db, "sessions", now)
+}
+
+// deleteExpired deletes rows of table whose expires_at is before now.
+func deleteExpired(db *sql.DB, table string, now time.Time) int {
+	res, err := db.Exec(`DELETE FROM `+table+` WHERE expires_at < ?`, toMillis(now))
+	if err != nil {
+		log.Printf("Failed to delete expired %s: %v", table, err)
+		return 0
+	}
+	n, _ := res.RowsAffected()
+	return int(n)
+}
+
+type sqlRefreshTokenStore struct {
+	db *sql.DB
+}
+
+const refreshTokenColumns = `user_id, family_id, client_id, scope, auth_time, amr, expires_at, rotated_at`
+
+func scanTokenInfo(row rowScanner) (*TokenInfo, error) {
+	var info TokenInfo
+	var authTime, expiresAt, rotatedAt int64
+	var amr string
+	err := row.Scan(&info.UserID, &info.FamilyID, &info.ClientID, &info.Scope,
+		&authTime, &amr, &expiresAt, &rotatedAt)
+	if err != nil {
+		return nil, err
+	}
+	info.AuthTime = fromMillis(authTime)
+	info.AMR = splitAMR(amr)
+	info.ExpiresAt = fromMillis(expiresAt)
+	info.RotatedAt = fromMillis(rotatedAt)
+	return &info, nil
+}
+
+func (s *sqlRefreshTokenStore) Store(token string, info *TokenInfo, sessionToken string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO refresh_tokens (token, `+refreshTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		token, info.UserID, info.FamilyID, info.ClientID, info.Scope,
+		toMillis(info.AuthTime), joinAMR(info.AMR), toMillis(info.ExpiresAt), toMillis(info.RotatedAt))
+	if err != nil {
+		return err
+	}
+	if sessionToken != "" {
+		// Only the newest session is kept, as in RefreshTokenStore
+		if _, err := tx.Exec(`DELETE FROM token_family_sessions WHERE family_id = ?`, info.FamilyID); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO token_family_sessions (family_id, session_token) VALUES (?, ?)`,
+			info.FamilyID, sessionToken)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlRefreshTokenStore) Get(token string) (TokenInfo, bool) {
+	info, err := scanTokenInfo(s.db.QueryRow(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE token = ?`, token))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to load refresh token: %v", err)
+		}
+		return TokenInfo{}, false
+	}
+	if !info.RotatedAt.IsZero() || time.Now().After(info.ExpiresAt) {
+		return TokenInfo{}, false
+	}
+	return *info, true
+}
+
+func (s *sqlRefreshTokenStore) Rotate(token, clientID string) (*TokenInfo, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	info, err := scanTokenInfo(tx.QueryRow(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE token = ?`, token))
+	if err == sql.ErrNoRows {
+		return nil, errRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.ClientID != clientID || time.Now().After(info.ExpiresAt) {
+		return nil, errRefreshTokenInvalid
+	}
+	if !info.RotatedAt.IsZero() {
+		return info, errRefreshTokenReused
+	}
+
+	info.RotatedAt = time.Now()
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET rotated_at = ? WHERE token = ?`, toMillis(info.RotatedAt), token); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (s *sqlRefreshTokenStore) RevokeFamily(familyID string) []string {
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Printf("Failed to revoke token family: %v", err)
+		return nil
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT session_token FROM token_family_sessions WHERE family_id = ?`, familyID)
+	if err != nil {
+		log.Printf("Failed to revoke token family: %v", err)
+		return nil
+	}
+	var sessions []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			rows.Close()
+			log.Printf("Failed to revoke token family: %v", err)
+			return nil
+		}
+		sessions = append(sessions, token)
+	}
+	rows.Close()
+
+	if _, err := tx.Exec(`DELETE FROM refresh_tokens WHERE family_id = ?`, familyID); err != nil {
+		log.Printf("Failed to revoke token family: %v", err)
+		return nil
+	}
+	if _, err := tx.Exec(`DELETE FROM token_family_sessions WHERE family_id = ?`, familyID); err != nil {
+		log.Printf("Failed to revoke token family: %v", err)
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to revoke token family: %v", err)
+		return nil
+	}
+	return sessions
+}
+
+func (s *sqlRefreshTokenStore) Revoke(token string) {
+	if _, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE token = ?`, token); err != nil {
+		log.Printf("Failed to revoke refresh token: %v", err)
+	}
+}
+
+func (s *sqlRefreshTokenStore) UserFamilies(userID string) []string {
+	rows, err := s.db.Query(`SELECT DISTINCT family_id FROM refresh_tokens WHERE user_id = ? AND expires_at > ?`,
+		userID, toMillis(time.Now()))
+	if err != nil {
+		log.Printf("Failed to list token families: %v", err)
+		return []string{}
+	}
+	defer rows.Close()
+
+	families := []string{}
+	for rows.Next() {
+		var family string
+		if err := rows.Scan(&family); err != nil {
+			log.Printf("Failed to list token families: %v", err)
+			return []string{}
+		}
+		families = append(families, family)
+	}
+	return families
+}
+
+func (s *sqlRefreshTokenStore) DeleteExpired(now time.Time) int {
+	evicted := deleteExpired(s.db, "refresh_tokens", now)
+	if evicted > 0 {
+		_, err := s.db.Exec(`DELETE FROM token_family_sessions WHERE family_id NOT IN (SELECT family_id FROM refresh_tokens)`)
+		if err != nil {
+			log.Printf("Failed to delete expired token families: %v", err)
+		}
+	}
+	return evicted
+}
+
+type sqlResetTokenStore struct {
+	db *sql.DB
+}
+
+func (s *sqlResetTokenStore) Create(token *PasswordResetToken) error {
+	_, err := s.db.Exec(`INSERT INTO password_reset_tokens (token, user_id, expires_at) VALUES (?, ?, ?)`,
+		token.Token, token.UserID, toMillis(token.ExpiresAt))
+	return err
+}
+
+func (s *sqlResetTokenStore) Consume(token string) (*PasswordResetToken, bool) {
+	var resetToken PasswordResetToken
+	var expiresAt int64
+	err := s.db.QueryRow(`DELETE FROM password_reset_tokens WHERE token = ? RETURNING token, user_id, expires_at`, token).
+		Scan(&resetToken.Token, &resetToken.UserID, &expiresAt)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to consume reset token: %v", err)
+		}
+		return nil, false
+	}
+	resetToken.ExpiresAt = fromMillis(expiresAt)
+	if time.Now().After(resetToken.ExpiresAt) {
+		return nil, false
+	}
+	return &resetToken, true
+}
+
+func (s *sqlResetTokenStore) DeleteExpired(now time.Time) int {
+	return deleteExpired(s.db, "password_reset_tokens", now)
+}
+
+type sqlVerificationTokenStore struct {
+	db *sql.DB
+}
+
+func (s *sqlVerificationTokenStore) Create(token *VerificationToken) error {
+	_, err := s.db.Exec(`INSERT INTO verification_tokens (token, user_id, email, expires_at) VALUES (?, ?, ?, ?)`,
+		token.Token, token.UserID, token.Email, toMillis(token.ExpiresAt))
+	return err
+}
+
+func (s *sqlVerificationTokenStore) Consume(token string) (*VerificationToken, bool) {
+	var verificationToken VerificationToken
+	var expiresAt int64
+	err := s.db.QueryRow(`DELETE FROM verification_tokens WHERE token = ? RETURNING token, user_id, email, expires_at`, token).
+		Scan(&verificationToken.Token, &verificationToken.UserID, &verificationToken.Email, &expiresAt)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to consume verification token: %v", err)
+		}
+		return nil, false
+	}
+	verificationToken.ExpiresAt = fromMillis(expiresAt)
+	if time.Now().After(verificationToken.ExpiresAt) {
+		return nil, false
+	}
+	return &verificationToken, true
+}
+
+func (s *sqlVerificationTokenStore) DeleteExpired(now time.Time) int {
+	return deleteExpired(s.db, "verification_tokens", now)
+}
+
+type sqlMFAStore struct {
+	db *sql.DB
+}
+
+const mfaColumns = `user_id, secret, confirmed, recovery_codes, last_step, created_at`
+
+func scanMFAEnrollment(row rowScanner) (*MFAEnrollment, error) {
+	var e MFAEnrollment
+	var recoveryCodes string
+	var createdAt int64
+	if err := row.Scan(&e.UserID, &e.Secret, &e.Confirmed, &recoveryCodes, &e.LastStep, &createdAt); err != nil {
+		return nil, err
+	}
+	e.RecoveryCodes = strings.Fields(recoveryCodes)
+	e.CreatedAt = fromMillis(createdAt)
+	return &e, nil
+}
+
+func (s *sqlMFAStore) Begin(userID, secret string) error {
+	e := newMFAEnrollment(userID, secret)
+	// Restarting an unconfirmed enrollment replaces it; a confirmed one
+	// stays as it is
+	res, err := s.db.Exec(`INSERT INTO mfa_enrollments (`+mfaColumns+`) VALUES (?, ?, 0, '', 0, ?)
+		ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, recovery_codes = '', last_step = 0,
+			created_at = excluded.created_at
+		WHERE confirmed = 0`,
+		e.UserID, e.Secret, toMillis(e.CreatedAt))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errMFAAlreadyEnabled
+	}
+	return nil
+}
+
+// update runs change on the user's enrollment inside a transaction and
+// saves the enrollment if change reports that it modified it.
+func (s *sqlMFAStore) update(userID string, change func(e *MFAEnrollment) bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	e, err := scanMFAEnrollment(tx.QueryRow(`SELECT `+mfaColumns+` FROM mfa_enrollments WHERE user_id = ?`, userID))
+	if err == sql.ErrNoRows {
+		return errMFANotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	if !change(e) {
+		return nil
+	}
+	_, err = tx.Exec(`UPDATE mfa_enrollments SET confirmed = ?, recovery_codes = ?, last_step = ? WHERE user_id = ?`,
+		e.Confirmed, strings.Join(e.RecoveryCodes, " "), e.LastStep, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlMFAStore) Confirm(userID, code string) ([]string, error) {
+	var codes []string
+	var confirmErr error
+	err := s.update(userID, func(e *MFAEnrollment) bool {
+		codes, confirmErr = e.confirm(code, time.Now())
+		return confirmErr == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, confirmErr
+}
+
+func (s *sqlMFAStore) Enabled(userID string) bool {
+	var confirmed bool
+	err := s.db.QueryRow(`SELECT confirmed FROM mfa_enrollments WHERE user_id = ?`, userID).Scan(&confirmed)
+	if err != nil && err != sql.ErrNoRows {
+		// Don't let a database error skip the second factor
+		log.Printf("Failed to load MFA enrollment: %v", err)
+		return true
+	}
+	return confirmed
+}
+
+func (s *sqlMFAStore) VerifyTOTP(userID, code string) bool {
+	ok := false
+	err := s.update(userID, func(e *MFAEnrollment) bool {
+		ok = e.verifyTOTP(code, time.Now())
+		return ok
+	})
+	if err != nil && err != errMFANotEnrolled {
+		log.Printf("Failed to verify TOTP code: %v", err)
+		return false
+	}
+	return ok && err == nil
+}
+
+func (s *sqlMFAStore) UseRecoveryCode(userID, code string) bool {
+	ok := false
+	err := s.update(userID, func(e *MFAEnrollment) bool {
+		ok = e.useRecoveryCode(code)
+		return ok
+	})
+	if err != nil && err != errMFANotEnrolled {
+		log.Printf("Failed to use recovery code: %v", err)
+		return false
+	}
+	return ok && err == nil
+}
+
+func (s *sqlMFAStore) Disable(userID string) {
+	if _, err := s.db.Exec(`DELETE FROM mfa_enrollments WHERE user_id = ?`, userID); err != nil {
+		log.Printf("Failed to disable MFA: %v", err)
+	}
+}
+
+type sqlPasskeyStore struct {
+	db *sql.DB
+}
+
+const passkeyColumns = `id, user_id, name, public_key, algorithm, sign_count, transports, aaguid, created_at, last_used_at`
+
+func scanPasskey(row rowScanner) (*WebAuthnCredential, error) {
+	var cred WebAuthnCredential
+	var transports string
+	var createdAt, lastUsedAt int64
+	err := row.Scan(&cred.ID, &cred.UserID, &cred.Name, &cred.PublicKey, &cred.Algorithm, &cred.SignCount,
+		&transports, &cred.AAGUID, &createdAt, &lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	cred.Transports = strings.Fields(transports)
+	cred.CreatedAt = fromMillis(createdAt)
+	cred.LastUsedAt = fromMillis(lastUsedAt)
+	return &cred, nil
+}
+
+func (s *sqlPasskeyStore) Add(cred *WebAuthnCredential) error {
+	_, err := s.db.Exec(`INSERT INTO passkeys (`+passkeyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		cred.ID, cred.UserID, cred.Name, cred.PublicKey, cred.Algorithm, cred.SignCount,
+		strings.Join(cred.Transports, " "), cred.AAGUID, toMillis(cred.CreatedAt), toMillis(cred.LastUsedAt))
+	if isUniqueViolation(err) {
+		return errPasskeyExists
+	}
+	return err
+}
+
+func (s *sqlPasskeyStore) Get(id string) (WebAuthnCredential, bool) {
+	cred, err := scanPasskey(s.db.QueryRow(`SELECT `+passkeyColumns+` FROM passkeys WHERE id = ?`, id))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to load passkey: %v", err)
+		}
+		return WebAuthnCredential{}, false
+	}
+	return *cred, true
+}
+
+func (s *sqlPasskeyStore) ListByUser(userID string) []WebAuthnCredential {
+	rows, err := s.db.Query(`SELECT `+passkeyColumns+` FROM passkeys WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		log.Printf("Failed to list passkeys: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var creds []WebAuthnCredential
+	for rows.Next() {
+		cred, err := scanPasskey(rows)
+		if err != nil {
+			log.Printf("Failed to list passkeys: %v", err)
+			return nil
+		}
+		creds = append(creds, *cred)
+	}
+	return creds
+}
+
+func (s *sqlPasskeyStore) HasPasskeys(userID string) bool {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM passkeys WHERE user_id = ?)`, userID).Scan(&exists)
+	if err != nil {
+		// Like sqlMFAStore.Enabled, fail closed rather than skip the second
+		// factor
+		log.Printf("Failed to look up passkeys: %v", err)
+		return true
+	}
+	return exists
+}
+
+func (s *sqlPasskeyStore) RecordUse(id string, signCount uint32) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var stored uint32
+	err = tx.QueryRow(`SELECT sign_count FROM passkeys WHERE id = ?`, id).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return errPasskeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !signCountAdvances(stored, signCount) {
+		return errPasskeyCloned
+	}
+	_, err = tx.Exec(`UPDATE passkeys SET sign_count = ?, last_used_at = ? WHERE id = ?`,
+		signCount, toMillis(time.Now()), id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlPasskeyStore) Delete(userID, id string) bool {
+	res, err := s.db.Exec(`DELETE FROM passkeys WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		log.Printf("Failed to delete passkey: %v", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+type sqlTrustedDeviceStore struct {
+	db *sql.DB
+}
+
+const trustedDeviceColumns = `token_hash, id, user_id, user_agent, ip_address, created_at, last_used_at, expires_at`
+
+func scanTrustedDevice(row rowScanner) (*TrustedDevice, error) {
+	var device TrustedDevice
+	var createdAt, lastUsedAt, expiresAt int64
+	err := row.Scan(&device.TokenHash, &device.ID, &device.UserID, &device.UserAgent, &device.IPAddress,
+		&createdAt, &lastUsedAt, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	device.CreatedAt = fromMillis(createdAt)
+	device.LastUsedAt = fromMillis(lastUsedAt)
+	device.ExpiresAt = fromMillis(expiresAt)
+	return &device, nil
+}
+
+func (s *sqlTrustedDeviceStore) Create(device *TrustedDevice) error {
+	_, err := s.db.Exec(`INSERT INTO trusted_devices (`+trustedDeviceColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		device.TokenHash, device.ID, device.UserID, device.UserAgent, device.IPAddress,
+		toMillis(device.CreatedAt), toMillis(device.LastUsedAt), toMillis(device.ExpiresAt))
+	return err
+}
+
+func (s *sqlTrustedDeviceStore) Verify(token, userID, userAgent string) bool {
+	if token == "" {
+		return false
+	}
+	hash := hashTrustedDeviceToken(token)
+	device, err := scanTrustedDevice(s.db.QueryRow(`SELECT `+trustedDeviceColumns+` FROM trusted_devices WHERE token_hash = ?`, hash))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to load trusted device: %v", err)
+		}
+		return false
+	}
+	now := time.Now()
+	if !device.matches(userID, userAgent, now) {
+		return false
+	}
+	if _, err := s.db.Exec(`UPDATE trusted_devices SET last_used_at = ? WHERE token_hash = ?`, toMillis(now), hash); err != nil {
+		log.Printf("Failed to update trusted device: %v", err)
+	}
+	return true
+}
+
+func (s *sqlTrustedDeviceStore) List(userID string) []TrustedDevice {
+	rows, err := s.db.Query(`SELECT `+trustedDeviceColumns+` FROM trusted_devices WHERE user_id = ? AND expires_at > ?`,
+		userID, toMillis(time.Now()))
+	if err != nil {
+		log.Printf("Failed to list trusted devices: %v", err)
+		return []TrustedDevice{}
+	}
+	defer rows.Close()
+
+	devices := []TrustedDevice{}
+	for rows.Next() {
+		device, err := scanTrustedDevice(rows)
+		if err != nil {
+			log.Printf("Failed to list trusted devices: %v", err)
+			return []TrustedDevice{}
+		}
+		devices = append(devices, *device)
+	}
+	return devices
+}
+
+func (s *sqlTrustedDeviceStore) Revoke(userID, id string) bool {
+	res, err := s.db.Exec(`DELETE FROM trusted_devices WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		log.Printf("Failed to revoke trusted device: %v", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+func (s *sqlTrustedDeviceStore) RevokeAll(userID string) {
+	if _, err := s.db.Exec(`DELETE FROM trusted_devices WHERE user_id = ?`, userID); err != nil {
+		log.Printf("Failed to revoke trusted devices: %v", err)
+	}
+}
+
+func (s *sqlTrustedDeviceStore) DeleteExpired(now time.Time) int {
+	return deleteExpired(s.db, "trusted_devices", now)
+}
+
+type sqlClientStore struct {
+	db *sql.DB
+}
+
+const clientColumns = `id, name, secret_hash, public, disabled, redirect_uris, scopes, token_exchange, created_at`
+
+func scanClient(row rowScanner) (*OAuthClient, error) {
+	var client OAuthClient
+	var redirectURIs, scopes, tokenExchange string
+	var createdAt int64
+	err := row.Scan(&client.ID, &client.Name, &client.SecretHash, &client.Public, &client.Disabled,
+		&redirectURIs, &scopes, &tokenExchange, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	client.Scopes = strings.Fields(scopes)
+	if tokenExchange != "" {
+		client.TokenExchange = &ExchangePolicy{}
+		if err := json.Unmarshal([]byte(tokenExchange), client.TokenExchange); err != nil {
+			return nil, err
+		}
+	}
+	client.CreatedAt = fromMillis(createdAt)
+	return &client, nil
+}
+
+// put inserts client, or with replace overwrites a client with its ID.
+func (s *sqlClientStore) put(client *OAuthClient, replace bool) error {
+	tokenExchange := ""
+	if client.TokenExchange != nil {
+		data, err := json.Marshal(client.TokenExchange)
+		if err != nil {
+			return err
+		}
+		tokenExchange = string(data)
+	}
+	verb := `INSERT`
+	if replace {
+		verb = `INSERT OR REPLACE`
+	}
+	_, err := s.db.Exec(verb+` INTO oauth_clients (`+clientColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		client.ID, client.Name, client.SecretHash, client.Public, client.Disabled,
+		strings.Join(client.RedirectURIs, " "), strings.Join(client.Scopes, " "), tokenExchange, toMillis(client.CreatedAt))
+	if isUniqueViolation(err) {
+		return errClientExists
+	}
+	return err
+}
+
+func (s *sqlClientStore) Register(client *OAuthClient, secret string) error {
+	if err := prepareClient(client, secret); err != nil {
+		return err
+	}
+	return s.put(client, false)
+}
+
+func (s *sqlClientStore) Configure(client *OAuthClient, secret string) error {
+	if err := prepareClient(client, secret); err != nil {
+		return err
+	}
+	return s.put(client, true)
+}
+
+func (s *sqlClientStore) Get(id string) (*OAuthClient, bool) {
+	client, err := scanClient(s.db.QueryRow(`SELECT `+clientColumns+` FROM oauth_clients WHERE id = ?`, id))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to load client: %v", err)
+		}
+		return nil, false
+	}
+	return client, true
+}
+
+func (s *sqlClientStore) RotateSecret(id string) (string, error) {
+	secret, hash, err := newClientSecret()
+	if err != nil {
+		return "", err
+	}
+	res, err := s.db.Exec(`UPDATE oauth_clients SET secret_hash = ? WHERE id = ? AND public = 0`, hash, id)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", errClientNotFound
+	}
+	return secret, nil
+}
+
+func (s *sqlClientStore) SetDisabled(id string, disabled bool) error {
+	res, err := s.db.Exec(`UPDATE oauth_clients SET disabled = ? WHERE id = ?`, disabled, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errClientNotFound
+	}
+	return nil
+}
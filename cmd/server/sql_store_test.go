@@ -0,0 +1,47 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLSecondFactorChecksFailClosed(t *testing.T) {
+	db, err := openSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfa := &sqlMFAStore{db: db}
+	passkeys := &sqlPasskeyStore{db: db}
+	if mfa.Enabled("sql-user") || passkeys.HasPasskeys("sql-user") {
+		t.Fatal("second factor reported for a user without one")
+	}
+
+	// A database error must not let a sign-in skip the second factor
+	db.Close()
+	if !mfa.Enabled("sql-user") {
+		t.Error("MFA check failed open")
+	}
+	if !passkeys.HasPasskeys("sql-user") {
+		t.Error("passkey check failed open")
+	}
+}
+
+func TestSQLRefreshFamilyKeepsNewestSession(t *testing.T) {
+	db, err := openSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rts := &sqlRefreshTokenStore{db: db}
+	for _, n := range []string{"1", "2", "3"} {
+		info := &TokenInfo{UserID: "sql-user", FamilyID: "sql-family", ExpiresAt: time.Now().Add(time.Hour)}
+		if err := rts.Store("refresh-"+n, info, "session-"+n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sessions := rts.RevokeFamily("sql-family"); len(sessions) != 1 || sessions[0] != "session-3" {
+		t.Fatalf("family linked %v, want the newest session only", sessions)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	errUserExists   = errors.New("user already exists")
+	errUserNotFound = errors.New("user not found")
+)
+
+// UserRepository stores accounts. Emails are unique and looked up without
+// regard to case. Lookups return copies, so changes must be saved with
+// Update.
+type UserRepository interface {
+	Create(user *User) error
+	GetByID(id string) (*User, bool)
+	GetByEmail(email string) (*User, bool)
+	Update(user *User) error
+}
+
+// SessionRepository stores sessions keyed by their access token.
+type SessionRepository interface {
+	Create(session *Session) error
+	Get(token string) (*Session, bool)
+	Delete(token string)
+	// Touch records that the session was used at lastSeen and moves its
+	// expiry.
+	Touch(token string, lastSeen, expiresAt time.Time)
+	GetUserSessions(userID string) []*Session
+	// DeleteExpired removes sessions that expired before now and returns
+	// how many there were.
+	DeleteExpired(now time.Time) int
+}
+
+// RefreshTokenRepository stores refresh tokens grouped into families for
+// reuse detection.
+type RefreshTokenRepository interface {
+	Store(token string, info *TokenInfo, sessionToken string) error
+	Get(token string) (TokenInfo, bool)
+	Rotate(token, clientID string) (*TokenInfo, error)
+	RevokeFamily(familyID string) []string
+	Revoke(token string)
+	// UserFamilies returns the IDs of the user's families that still have
+	// a refresh token.
+	UserFamilies(userID string) []string
+	// DeleteExpired removes expired tokens, rotated or not, and families
+	// left without any.
+	DeleteExpired(now time.Time) int
+}
+
+// ResetTokenRepository stores password reset tokens. Consume returns a live
+// token and deletes it, so each can only be used once.
+type ResetTokenRepository interface {
+	Create(token *PasswordResetToken) error
+	Consume(token string) (*PasswordResetToken, bool)
+	DeleteExpired(now time.Time) int
+}
+
+// VerificationTokenRepository stores email verification tokens.
+type VerificationTokenRepository interface {
+	Create(token *VerificationToken) error
+	Consume(token string) (*VerificationToken, bool)
+	DeleteExpired(now time.Time) int
+}
+
+// MFARepository stores TOTP enrollments. Accepting a code or recovery code
+// and recording that it was used happen together, so neither works twice.
+type MFARepository interface {
+	Begin(userID, secret string) error
+	Confirm(userID, code string) ([]string, error)
+	Enabled(userID string) bool
+	VerifyTOTP(userID, code string) bool
+	UseRecoveryCode(userID, code string) bool
+	Disable(userID string)
+}
+
+// PasskeyRepository stores WebAuthn credentials by credential ID.
+type PasskeyRepository interface {
+	Add(cred *WebAuthnCredential) error
+	Get(id string) (WebAuthnCredential, bool)
+	ListByUser(userID string) []WebAuthnCredential
+	HasPasskeys(userID string) bool
+	// RecordUse saves a new sign count, or fails with errPasskeyCloned if
+	// it doesn't advance
+	RecordUse(id string, signCount uint32) error
+	Delete(userID, id string) bool
+}
+
+// TrustedDeviceRepository stores remembered browsers by token hash.
+type TrustedDeviceRepository interface {
+	Create(device *TrustedDevice) error
+	Verify(token, userID, userAgent string) bool
+	List(userID string) []TrustedDevice
+	Revoke(userID, id string) bool
+	RevokeAll(userID string)
+	DeleteExpired(now time.Time) int
+}
+
+// ClientRepository stores OAuth clients. Register refuses an ID that is
+// taken; Configure replaces it, for clients defined in configuration.
+type ClientRepository interface {
+	Register(client *OAuthClient, secret string) error
+	Configure(client *OAuthClient, secret string) error
+	Get(id string) (*OAuthClient, bool)
+	RotateSecret(id string) (string, error)
+	SetDisabled(id string, disabled bool) error
+}
+
+// closeStorage flushes and releases the configured backend on shutdown.
+var closeStorage = func() error { return nil }
+
+// configureStorage swaps the in-memory stores for the backend named by
+// STORAGE (memory, sqlite or file). Handlers only see the repository
+// interfaces.
+func configureStorage() error {
+	switch backend := getEnv("STORAGE", "memory"); backend {
+	case "memory":
+		return nil
+	case "sqlite":
+		path := getEnv("DATABASE_PATH", "go-auth-api.db")
+		db, err := openSQLite(path)
+		if err != nil {
+			return err
+		}
+		store = &sqlUserStore{db: db}
+		sessionStore = &sqlSessionStore{db: db}
+		refreshTokens = &sqlRefreshTokenStore{db: db}
+		resetTokens = &sqlResetTokenStore{db: db}
+		verificationTokens = &sqlVerificationTokenStore{db: db}
+		mfaStore = &sqlMFAStore{db: db}
+		passkeyStore = &sqlPasskeyStore{db: db}
+		trustedDevices = &sqlTrustedDeviceStore{db: db}
+		clientStore = &sqlClientStore{db: db}
+		closeStorage = db.Close
+		log.Printf("Using SQLite storage at %s", path)
+		return nil
+	case "file":
+		dir := getEnv("DATA_DIR", "data")
+		interval, err := time.ParseDuration(getEnv("SNAPSHOT_INTERVAL", "5m"))
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid SNAPSHOT_INTERVAL %q", getEnv("SNAPSHOT_INTERVAL", "5m"))
+		}
+		fs, err := openFileStorage(dir)
+		if err != nil {
+			return err
+		}
+		store = fileUserStore{UserStore: fs.users, fs: fs}
+		sessionStore = fileSessionStore{SessionStore: fs.sessions, fs: fs}
+		refreshTokens = fileRefreshTokenStore{RefreshTokenStore: fs.refreshTokens, fs: fs}
+		resetTokens = fileResetTokenStore{ResetTokenStore: fs.resetTokens, fs: fs}
+		verificationTokens = fileVerificationTokenStore{VerificationTokenStore: fs.verificationTokens, fs: fs}
+		mfaStore = fileMFAStore{MFAStore: fs.mfa, fs: fs}
+		passkeyStore = filePasskeyStore{PasskeyStore: fs.passkeys, fs: fs}
+		trustedDevices = fileTrustedDeviceStore{TrustedDeviceStore: fs.trustedDevices, fs: fs}
+		clientStore = fileClientStore{ClientStore: fs.clients, fs: fs}
+		go fs.compactEvery(interval)
+		closeStorage = fs.Close
+		log.Printf("Using file storage in %s", dir)
+		return nil
+	default:
+		return fmt.Errorf("unknown STORAGE %q", backend)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// tokenHandler is the OAuth 2.0 token endpoint.
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid form body")
+		return
+	}
+
+	client, ok := identifyClient(r)
+	if !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		authorizationCodeGrant(w, r, client)
+	case "refresh_token":
+		refreshTokenGrant(w, r, client)
+	case "client_credentials":
+		clientCredentialsGrant(w, r, client)
+	case deviceCodeGrantType:
+		deviceCodeGrant(w, r, client)
+	case tokenExchangeGrantType:
+		tokenExchangeGrant(w, r, client)
+	case "":
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "grant_type is required")
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type")
+	}
+}
+
+func authorizationCodeGrant(w http.ResponseWriter, r *http.Request, client *OAuthClient) {
+	familyID := generateID()
+	code, ok := redeemAuthorizationCode(r,
+		r.PostForm.Get("code"),
+		client.ID,
+		r.PostForm.Get("redirect_uri"),
+		r.PostForm.Get("code_verifier"),
+		familyID,
+	)
+	if !ok {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+		return
+	}
+
+	token, err := issueTokens(r, Grant{
+		UserID:   code.UserID,
+		ClientID: client.ID,
+		Scope:    code.Scope,
+		FamilyID: familyID,
+		AuthTime: code.AuthTime,
+		AMR:      code.AMR,
+	})
+	if err == errSessionLimitReached {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Maximum number of active sessions reached")
+		return
+	}
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to issue token")
+		return
+	}
+
+	if hasScope(code.Scope, "openid") {
+		token.IDToken, err = issueIDToken(code, client.ID)
+		if err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to issue ID token")
+			return
+		}
+	}
+	writeTokenResponse(w, token)
+}
+
+func refreshTokenGrant(w http.ResponseWriter, r *http.Request, client *OAuthClient) {
+	refreshToken := r.PostForm.Get("refresh_token")
+
+	// Check a narrowed scope before the token is consumed
+	scope := r.PostForm.Get("scope")
+	if scope != "" {
+		info, exists := refreshTokens.Get(refreshToken)
+		if exists && !scopeSubset(parseScope(scope), parseScope(info.Scope)) {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "Scope exceeds the original grant")
+			return
+		}
+	}
+
+	info, err := rotateRefreshToken(r, refreshToken, client.ID)
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired refresh token")
+		return
+	}
+	if scope == "" {
+		scope = info.Scope
+	}
+
+	token, err := issueTokens(r, Grant{
+		UserID:       info.UserID,
+		ClientID:     client.ID,
+		Scope:        scope,
+		RefreshScope: info.Scope,
+		FamilyID:     info.FamilyID,
+		Refresh:      true,
+		AuthTime:     info.AuthTime,
+		AMR:          info.AMR,
+	})
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to issue token")
+		return
+	}
+	writeTokenResponse(w, token)
+}
+
+// clientCredentialsGrant issues a token to a confidential client acting on
+// its own behalf, so there is no user subject and no refresh token.
+func clientCredentialsGrant(w http.ResponseWriter, r *http.Request, client *OAuthClient) {
+	if client.Public {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "Public clients cannot use client_credentials")
+		return
+	}
+
+	scope := r.PostForm.Get("scope")
+	if scope == "" {
+		scope = strings.Join(client.Scopes, " ")
+	}
+	if !scopeSubset(parseScope(scope), client.Scopes) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "Requested scope is not allowed for this client")
+		return
+	}
+
+	token, err := issueAccessToken(r, Grant{ClientID: client.ID, Scope: scope})
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to issue token")
+		return
+	}
+	writeTokenResponse(w, token)
+}
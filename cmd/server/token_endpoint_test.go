@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefreshNarrowsOnlyAccessToken(t *testing.T) {
+	client := &OAuthClient{ID: "narrow-client", Public: true}
+	r := httptest.NewRequest("POST", "/oauth/token", nil)
+	issued, err := issueTokens(r, Grant{
+		UserID:   "narrow-user",
+		ClientID: client.ID,
+		Scope:    "read write",
+		AuthTime: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {issued.RefreshToken},
+		"scope":         {"read"},
+	}
+	r = httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ParseForm()
+	w := httptest.NewRecorder()
+	refreshTokenGrant(w, r, client)
+	if w.Code != 200 {
+		t.Fatalf("refresh returned %d: %s", w.Code, w.Body)
+	}
+
+	var token Token
+	if err := json.NewDecoder(w.Body).Decode(&token); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { revokeFamily("narrow-user", mustRefreshInfo(t, token.RefreshToken).FamilyID) })
+	if token.Scope != "read" {
+		t.Errorf("access token scope = %q, want %q", token.Scope, "read")
+	}
+	if scope := mustRefreshInfo(t, token.RefreshToken).Scope; scope != "read write" {
+		t.Errorf("refresh token scope = %q, want the original grant", scope)
+	}
+}
+
+func mustRefreshInfo(t *testing.T, token string) TokenInfo {
+	t.Helper()
+	info, exists := refreshTokens.Get(token)
+	if !exists {
+		t.Fatal("refresh token not stored")
+	}
+	return info
+}
@@ -1,45 +1,124 @@
 package main
 
 import (
+	"errors"
+	"net/http"
 	"sync"
 	"time"
 )
 
+const refreshTokenTTL = 7 * 24 * time.Hour
+
+var (
+	errRefreshTokenInvalid = errors.New("invalid or expired refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// RefreshTokenStore is the in-memory RefreshTokenRepository.
 type RefreshTokenStore struct {
-	mu     sync.RWMutex
-	tokens map[string]*TokenInfo
+	mu       sync.RWMutex
+	tokens   map[string]*TokenInfo
+	families map[string]*TokenFamily
 }
 
 type TokenInfo struct {
 	UserID    string
+	FamilyID  string
+	ClientID  string
+	Scope     string
+	AuthTime  time.Time
+	AMR       []string
 	ExpiresAt time.Time
+	// RotatedAt is set once the token has been exchanged for a successor.
+	// The entry is kept until it expires so a replay can be recognised.
+	RotatedAt time.Time
 }
 
-var refreshTokens = &RefreshTokenStore{
-	tokens: make(map[string]*TokenInfo),
+// TokenFamily groups every refresh token descended from one login. Sessions
+// holds the session (access token) issued with the newest refresh token;
+// the earlier ones share its session ID, which is the family ID, so they
+// need not be listed.
+type TokenFamily struct {
+	ID       string
+	UserID   string
+	Sessions []string
 }
 
-func (rts *RefreshTokenStore) Store(token, userID string, expiresIn time.Duration) {
+var refreshTokens RefreshTokenRepository = &RefreshTokenStore{
+	tokens:   make(map[string]*TokenInfo),
+	families: make(map[string]*TokenFamily),
+}
+
+// Store records a refresh token, creating its family if needed, and makes
+// sessionToken the family's session.
+func (rts *RefreshTokenStore) Store(token string, info *TokenInfo, sessionToken string) error {
 	rts.mu.Lock()
 	defer rts.mu.Unlock()
-	rts.tokens[token] = &TokenInfo{
-		UserID:    userID,
-		ExpiresAt: time.Now().Add(expiresIn),
+
+	family, exists := rts.families[info.FamilyID]
+	if !exists {
+		family = &TokenFamily{ID: info.FamilyID, UserID: info.UserID}
+		rts.families[info.FamilyID] = family
 	}
+	if sessionToken != "" {
+		family.Sessions = []string{sessionToken}
+	}
+
+	rts.tokens[token] = info
+	return nil
 }
 
-func (rts *RefreshTokenStore) Validate(token string) (string, bool) {
+// Get returns a copy of an active (unexpired, unrotated) refresh token.
+func (rts *RefreshTokenStore) Get(token string) (TokenInfo, bool) {
 	rts.mu.RLock()
 	defer rts.mu.RUnlock()
 	info, exists := rts.tokens[token]
-	if !exists {
-		return "", false
+	if !exists || !info.RotatedAt.IsZero() || time.Now().After(info.ExpiresAt) {
+		return TokenInfo{}, false
+	}
+	return *info, true
+}
+
+// Rotate marks token as used so the caller can issue its successor. The
+// token must have been issued to clientID ("" for first-party logins). If it
+// was already rotated, errRefreshTokenReused is returned along with the
+// token's info so the caller can revoke the family.
+func (rts *RefreshTokenStore) Rotate(token, clientID string) (*TokenInfo, error) {
+	rts.mu.Lock()
+	defer rts.mu.Unlock()
+
+	info, exists := rts.tokens[token]
+	if !exists || info.ClientID != clientID || time.Now().After(info.ExpiresAt) {
+		return nil, errRefreshTokenInvalid
+	}
+	if !info.RotatedAt.IsZero() {
+		i := *info
+		return &i, errRefreshTokenReused
+	}
+
+	info.RotatedAt = time.Now()
+	i := *info
+	return &i, nil
+}
+
+// RevokeFamily deletes every refresh token in the family and returns the
+// session token that was linked to it.
+func (rts *RefreshTokenStore) RevokeFamily(familyID string) []string {
+	rts.mu.Lock()
+	defer rts.mu.Unlock()
+
+	for token, info := range rts.tokens {
+		if info.FamilyID == familyID {
+			delete(rts.tokens, token)
+		}
 	}
-	if time.Now().After(info.ExpiresAt) {
-		delete(rts.tokens, token)
-		return "", false
+
+	family, exists := rts.families[familyID]
+	if !exists {
+		return nil
 	}
-	return info.UserID, true
+	delete(rts.families, familyID)
+	return family.Sessions
 }
 
 func (rts *RefreshTokenStore) Revoke(token string) {
@@ -48,7 +127,152 @@ func (rts *RefreshTokenStore) Revoke(token string) {
 	delete(rts.tokens, token)
 }
 
+func (rts *RefreshTokenStore) UserFamilies(userID string) []string {
+	rts.mu.RLock()
+	defer rts.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	families := []string{}
+	for _, info := range rts.tokens {
+		if info.UserID == userID && time.Now().Before(info.ExpiresAt) && !seen[info.FamilyID] {
+			seen[info.FamilyID] = true
+			families = append(families, info.FamilyID)
+		}
+	}
+	return families
+}
+
+func (rts *RefreshTokenStore) DeleteExpired(now time.Time) int {
+	rts.mu.Lock()
+	defer rts.mu.Unlock()
 
+	evicted := 0
+	live := make(map[string]bool)
+	for token, info := range rts.tokens {
+		if now.After(info.ExpiresAt) {
+			delete(rts.tokens, token)
+			evicted++
+			continue
+		}
+		live[info.FamilyID] = true
+	}
+	for id := range rts.families {
+		if !live[id] {
+			delete(rts.families, id)
+		}
+	}
+	return evicted
+}
 
+// Grant describes who a set of tokens is being issued to.
+type Grant struct {
+	UserID   string
+	ClientID string
+	Scope    string
+	// Audience overrides the default audience of this API, and Act names
+	// the party acting for UserID; both are only set by token exchange.
+	Audience string
+	Act      *Actor
+	// FamilyID continues an existing refresh token family; empty starts a
+	// new one.
+	FamilyID string
+	// Refresh marks grants that continue a sign-in. Any other grant for a
+	// user is a new sign-in and counts against the session limit.
+	Refresh bool
+	// AuthTime and AMR describe the user's authentication; they are zero
+	// for client tokens.
+	AuthTime time.Time
+	AMR      []string
+	// Exchanged marks tokens minted by token exchange, whose sessions are
+	// not sign-ins of their own
+	Exchanged bool
+	// RefreshScope is the scope of the refresh token when a refresh
+	// narrowed the access token; the refresh token keeps the original
+	// grant (RFC 6749 section 6). Empty means Scope.
+	RefreshScope string
+}
 
+// issueAccessToken mints an access token and its session without a refresh
+// token. UserID is empty for tokens a client obtained on its own behalf.
+// The session takes its ID from the grant's family, if it has one.
+func issueAccessToken(r *http.Request, g Grant) (Token, error) {
+	claims := jwtIssuer.NewClaims(g.UserID, g.ClientID, g.Scope)
+	if g.Audience != "" {
+		claims.Audience = g.Audience
+	}
+	claims.Act = g.Act
 
+	accessToken, err := jwtIssuer.Sign(claims)
+	if err != nil {
+		return Token{}, err
+	}
+	sessionID := g.FamilyID
+	if sessionID == "" {
+		sessionID = generateID()
+	}
+	now := time.Now()
+	session := &Session{
+		ID:         sessionID,
+		UserID:     g.UserID,
+		ClientID:   g.ClientID,
+		Token:      accessToken,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		IPAddress:  r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+		AuthTime:   g.AuthTime,
+		AMR:        g.AMR,
+		Exchanged:  g.Exchanged,
+	}
+	session.ExpiresAt = sessionExpiry(session, now)
+	if err := sessionStore.Create(session); err != nil {
+		return Token{}, err
+	}
+
+	return Token{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(accessTokenTTL.Seconds()),
+		Scope:       g.Scope,
+	}, nil
+}
+
+// issueTokens mints an access token with its session and a refresh token in
+// the grant's family.
+func issueTokens(r *http.Request, g Grant) (Token, error) {
+	if g.FamilyID == "" {
+		g.FamilyID = generateID()
+	}
+	if !g.Refresh && g.UserID != "" && sessionLimit.Max > 0 {
+		sessionLimit.mu.Lock()
+		defer sessionLimit.mu.Unlock()
+		if err := enforceSessionLimit(r, g.UserID); err != nil {
+			return Token{}, err
+		}
+	}
+	token, err := issueAccessToken(r, g)
+	if err != nil {
+		return Token{}, err
+	}
+
+	refreshScope := g.RefreshScope
+	if refreshScope == "" {
+		refreshScope = g.Scope
+	}
+	refreshToken := generateToken()
+	err = refreshTokens.Store(refreshToken, &TokenInfo{
+		UserID:    g.UserID,
+		FamilyID:  g.FamilyID,
+		ClientID:  g.ClientID,
+		Scope:     refreshScope,
+		AuthTime:  g.AuthTime,
+		AMR:       g.AMR,
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	}, token.AccessToken)
+	if err != nil {
+		return Token{}, err
+	}
+
+	token.RefreshToken = refreshToken
+	return token, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trustedDeviceTTL is how long a remembered browser skips the second
+// factor. Set from TRUSTED_DEVICE_TTL.
+var trustedDeviceTTL = 30 * 24 * time.Hour
+
+// TrustedDevice lets a browser skip the MFA prompt after a correct password.
+// Only a hash of its token is kept, and the token is only honoured for the
+// same user and user agent it was issued to.
+type TrustedDevice struct {
+	ID         string    `json:"id"`
+	TokenHash  string    `json:"-"`
+	UserID     string    `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// TrustedDeviceStore is the in-memory TrustedDeviceRepository. It is keyed
+// by token hash, since that is how logins look devices up.
+type TrustedDeviceStore struct {
+	mu      sync.Mutex
+	devices map[string]*TrustedDevice
+}
+
+var trustedDevices TrustedDeviceRepository = &TrustedDeviceStore{
+	devices: make(map[string]*TrustedDevice),
+}
+
+// issueTrustedDevice remembers the requesting browser for userID and
+// returns the token it must present on later logins. Without a stored
+// device the user is simply asked for a second factor again.
+func issueTrustedDevice(r *http.Request, userID string) string {
+	token := generateToken()
+	now := time.Now()
+	device := &TrustedDevice{
+		ID:         generateID(),
+		TokenHash:  hashTrustedDeviceToken(token),
+		UserID:     userID,
+		UserAgent:  r.UserAgent(),
+		IPAddress:  r.RemoteAddr,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(trustedDeviceTTL),
+	}
+	if err := trustedDevices.Create(device); err != nil {
+		log.Printf("Failed to store trusted device: %v", err)
+		return ""
+	}
+	return token
+}
+
+func (ts *TrustedDeviceStore) Create(device *TrustedDevice) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	d := *device
+	ts.devices[device.TokenHash] = &d
+	return nil
+}
+
+// Verify reports whether token is a live trusted device for userID on this
+// user agent, and records its use.
+func (ts *TrustedDeviceStore) Verify(token, userID, userAgent string) bool {
+	if token == "" {
+		return false
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	device, exists := ts.devices[hashTrustedDeviceToken(token)]
+	if !exists || !device.matches(userID, userAgent, time.Now()) {
+		return false
+	}
+	device.LastUsedAt = time.Now()
+	return true
+}
+
+// get returns a copy of the device with the given token hash.
+func (ts *TrustedDeviceStore) get(tokenHash string) (TrustedDevice, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	device, exists := ts.devices[tokenHash]
+	if !exists {
+		return TrustedDevice{}, false
+	}
+	return *device, true
+}
+
+// matches reports whether the device may stand in for a second factor for
+// userID on userAgent at now.
+func (d *TrustedDevice) matches(userID, userAgent string, now time.Time) bool {
+	return now.Before(d.ExpiresAt) && d.UserID == userID && d.UserAgent == userAgent
+}
+
+func (ts *TrustedDeviceStore) List(userID string) []TrustedDevice {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	devices := []TrustedDevice{}
+	for _, device := range ts.devices {
+		if device.UserID == userID && time.Now().Before(device.ExpiresAt) {
+			devices = append(devices, *device)
+		}
+	}
+	return devices
+}
+
+func (ts *TrustedDeviceStore) Revoke(userID, id string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for hash, device := range ts.devices {
+		if device.ID == id && device.UserID == userID {
+			delete(ts.devices, hash)
+			return true
+		}
+	}
+	return false
+}
+
+// RevokeAll forgets every device of userID, e.g. when MFA is turned off.
+func (ts *TrustedDeviceStore) RevokeAll(userID string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for hash, device := range ts.devices {
+		if device.UserID == userID {
+			delete(ts.devices, hash)
+		}
+	}
+}
+
+func (ts *TrustedDeviceStore) DeleteExpired(now time.Time) int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	evicted := 0
+	for hash, device := range ts.devices {
+		if now.After(device.ExpiresAt) {
+			delete(ts.devices, hash)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+func hashTrustedDeviceToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// requiresMFA reports whether a login for userID must still present a
+// second factor, given the trusted device token the client sent. Either
+// TOTP or a registered passkey makes the account a two-factor one.
+func requiresMFA(r *http.Request, userID, deviceToken string) bool {
+	if !hasSecondFactor(userID) {
+		return false
+	}
+	return !trustedDevices.Verify(deviceToken, userID, r.UserAgent())
+}
+
+// trustedLoginResponse is a Token plus the trusted device token issued
+// when the user asked to remember the browser.
+type trustedLoginResponse struct {
+	Token
+	TrustedDeviceToken string `json:"trusted_device_token,omitempty"`
+}
+
+// trustedDevicesHandler lists the caller's trusted devices (GET
+// /api/users/me/trusted-devices) or revokes one (DELETE
+// /api/users/me/trusted-devices/{id}).
+func trustedDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromRequest(r)
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/users/me/trusted-devices"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"trusted_devices": trustedDevices.List(claims.Subject),
+		})
+	case r.Method == http.MethodDelete && id != "":
+		if !trustedDevices.Revoke(claims.Subject, id) {
+			http.Error(w, "Trusted device not found", http.StatusNotFound)
+			return
+		}
+		auditLogger.Log(claims.Subject, "trusted_device_revoked", "trusted_device", r.RemoteAddr, map[string]interface{}{
+			"device_id": id,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Trusted device revoked",
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
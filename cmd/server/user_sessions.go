@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SessionInfo is one sign-in as shown to its user. A sign-in can hold
+// several access tokens, one per refresh; they are folded into one entry.
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+	Browser    string    `json:"browser"`
+	OS         string    `json:"os"`
+	Current    bool      `json:"current"`
+}
+
+// listUserSessions returns the user's active sign-ins, most recently used
+// first. currentID marks the caller's own.
+func listUserSessions(userID, currentID string) []SessionInfo {
+	// Client tokens have no user, and all share the empty user ID
+	if userID == "" {
+		return []SessionInfo{}
+	}
+	byID := make(map[string]*SessionInfo)
+	for _, session := range sessionStore.GetUserSessions(userID) {
+		if session.Exchanged {
+			continue
+		}
+		createdAt := session.CreatedAt
+		if !session.AuthTime.IsZero() {
+			createdAt = session.AuthTime
+		}
+
+		info, exists := byID[session.ID]
+		if !exists {
+			info = &SessionInfo{ID: session.ID, CreatedAt: createdAt, Current: session.ID == currentID}
+			byID[session.ID] = info
+		}
+		if createdAt.Before(info.CreatedAt) {
+			info.CreatedAt = createdAt
+		}
+		// Where the sign-in was last used from is the interesting part
+		if session.LastSeenAt.After(info.LastSeenAt) {
+			info.LastSeenAt = session.LastSeenAt
+			info.IPAddress = session.IPAddress
+			info.UserAgent = session.UserAgent
+			info.Browser, info.OS = parseUserAgent(session.UserAgent)
+		}
+	}
+
+	sessions := make([]SessionInfo, 0, len(byID))
+	for _, info := range byID {
+		sessions = append(sessions, *info)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions
+}
+
+// revokeSession signs out one sign-in: its refresh tokens and every access
+// token issued from it. It reports whether the user had such a sign-in.
+func revokeSession(userID, id string) bool {
+	if userID == "" {
+		return false
+	}
+	found := false
+	for _, family := range refreshTokens.UserFamilies(userID) {
+		if family == id {
+			revokeFamily(userID, family)
+			found = true
+		}
+	}
+	for _, session := range sessionStore.GetUserSessions(userID) {
+		if session.ID == id {
+			sessionStore.Delete(session.Token)
+			found = true
+		}
+	}
+	return found
+}
+
+// revokeOtherSessions signs out every sign-in of the user except keepID and
+// returns how many there were.
+func revokeOtherSessions(userID, keepID string) int {
+	if userID == "" {
+		return 0
+	}
+	revoked := make(map[string]bool)
+	for _, family := range refreshTokens.UserFamilies(userID) {
+		if family != keepID {
+			revokeFamily(userID, family)
+			revoked[family] = true
+		}
+	}
+	for _, session := range sessionStore.GetUserSessions(userID) {
+		if session.ID != keepID {
+			sessionStore.Delete(session.Token)
+			// Exchanged tokens go too, but aren't sign-ins to report
+			if !session.Exchanged {
+				revoked[session.ID] = true
+			}
+		}
+	}
+	return len(revoked)
+}
+
+// userSessionsHandler lists the caller's sessions (GET
+// /api/users/me/sessions), revokes one (DELETE /api/users/me/sessions/{id})
+// or all but the current one (POST /api/users/me/sessions/revoke-others).
+func userSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := claimsFromRequest(r)
+	if claims == nil || claims.Subject == "" {
+		http.Error(w, "User token required", http.StatusForbidden)
+		return
+	}
+	current, _ := sessionFromRequest(r)
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/users/me/sessions"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sessions": listUserSessions(claims.Subject, current.ID),
+		})
+	case r.Method == http.MethodPost && id == "revoke-others":
+		revoked := revokeOtherSessions(claims.Subject, current.ID)
+		auditLogger.Log(claims.Subject, "sessions_revoked", "session", r.RemoteAddr, map[string]interface{}{
+			"revoked": revoked,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Signed out of all other sessions",
+			"revoked": revoked,
+		})
+	case r.Method == http.MethodDelete && id != "":
+		if !revokeSession(claims.Subject, id) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		auditLogger.Log(claims.Subject, "session_revoked", "session", r.RemoteAddr, map[string]interface{}{
+			"session_id": id,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Session revoked",
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseUserAgent picks a readable browser and OS name out of a User-Agent
+// header. It only knows the common cases; anything else is "Unknown".
+func parseUserAgent(ua string) (browser, os string) {
+	browser, os = "Unknown", "Unknown"
+
+	// Order matters: Edge and Opera also claim to be Chrome, and Chrome
+	// claims to be Safari
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"CriOS/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	for _, o := range []struct{ token, name string }{
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			os = o.name
+			break
+		}
+	}
+	return browser, os
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func createTestSession(t *testing.T, id, userID, clientID, token string) *Session {
+	t.Helper()
+	now := time.Now()
+	session := &Session{
+		ID:         id,
+		UserID:     userID,
+		ClientID:   clientID,
+		Token:      token,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(time.Hour),
+	}
+	if err := sessionStore.Create(session); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sessionStore.Delete(token) })
+	return session
+}
+
+func sessionsRequest(method, path string, claims *Claims, session *Session) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	return withSession(withClaims(r, claims), session)
+}
+
+func TestUserSessionsRejectsClientTokens(t *testing.T) {
+	svcA := createTestSession(t, "family-svc-a", "", "svcA", "token-svc-a")
+	createTestSession(t, "family-svc-b", "", "svcB", "token-svc-b")
+	claims := &Claims{ClientID: "svcA"}
+
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodGet, "/api/users/me/sessions"},
+		{http.MethodPost, "/api/users/me/sessions/revoke-others"},
+		{http.MethodDelete, "/api/users/me/sessions/family-svc-b"},
+	} {
+		w := httptest.NewRecorder()
+		userSessionsHandler(w, sessionsRequest(tc.method, tc.path, claims, svcA))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s with a client token: got %d, want %d", tc.method, tc.path, w.Code, http.StatusForbidden)
+		}
+	}
+
+	if _, exists := sessionStore.Get("token-svc-b"); !exists {
+		t.Error("another client's session was revoked")
+	}
+}
+
+func TestUserSessionsListsOnlyOwnSessions(t *testing.T) {
+	own := createTestSession(t, "family-user", "user-1", "", "token-user")
+	createTestSession(t, "family-other", "user-2", "", "token-other")
+	createTestSession(t, "family-svc", "", "svcA", "token-svc")
+
+	w := httptest.NewRecorder()
+	userSessionsHandler(w, sessionsRequest(http.MethodGet, "/api/users/me/sessions", &Claims{Subject: "user-1"}, own))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var resp struct {
+		Sessions []SessionInfo `json:"sessions"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Sessions) != 1 || resp.Sessions[0].ID != "family-user" || !resp.Sessions[0].Current {
+		t.Errorf("got sessions %+v, want only the current family-user", resp.Sessions)
+	}
+}
+
+func TestUserSessionsExcludeExchangedTokens(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/oauth/token", nil)
+	signIn, err := issueAccessToken(r, Grant{UserID: "exchange-user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchanged, err := issueAccessToken(r, Grant{UserID: "exchange-user", ClientID: "svcA", Act: &Actor{Subject: "svcA"}, Exchanged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sessionStore.Delete(signIn.AccessToken)
+		sessionStore.Delete(exchanged.AccessToken)
+	})
+
+	if sessions := listUserSessions("exchange-user", ""); len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want only the sign-in", len(sessions))
+	}
+
+	// A full session limit is not reached by delegated tokens
+	saved := sessionLimit.Max
+	sessionLimit.Max = 2
+	t.Cleanup(func() { sessionLimit.Max = saved })
+	if err := enforceSessionLimit(r, "exchange-user"); err != nil {
+		t.Errorf("enforceSessionLimit: %v", err)
+	}
+	if _, exists := sessionStore.Get(signIn.AccessToken); !exists {
+		t.Error("sign-in evicted to make room")
+	}
+}
+
+func TestRevokeFamilyDeletesEarlierSessions(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/refresh", nil)
+	grant := Grant{UserID: "family-user", FamilyID: "family-sessions", AuthTime: time.Now()}
+	var accessTokens []string
+	for i := 0; i < 3; i++ {
+		token, err := issueTokens(r, grant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accessTokens = append(accessTokens, token.AccessToken)
+		grant.Refresh = true
+	}
+	t.Cleanup(func() { revokeFamily("family-user", "family-sessions") })
+
+	// Refreshing replaces the family's session rather than adding to it
+	rts := refreshTokens.(*RefreshTokenStore)
+	rts.mu.RLock()
+	linked := len(rts.families["family-sessions"].Sessions)
+	rts.mu.RUnlock()
+	if linked != 1 {
+		t.Fatalf("family links %d sessions, want the newest only", linked)
+	}
+
+	if revoked := revokeFamily("family-user", "family-sessions"); revoked != len(accessTokens) {
+		t.Errorf("revoked %d sessions, want %d", revoked, len(accessTokens))
+	}
+	for i, token := range accessTokens {
+		if _, exists := sessionStore.Get(token); exists {
+			t.Errorf("access token %d still has a session", i)
+		}
+	}
+}
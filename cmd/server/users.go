@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// UserStore is the in-memory UserRepository. Users are keyed by ID, with a
+// second index from normalized email to ID; both change under one lock.
+type UserStore struct {
+	mu      sync.RWMutex
+	users   map[string]*User
+	byEmail map[string]string
+}
+
+var store UserRepository = &UserStore{
+	users:   make(map[string]*User),
+	byEmail: make(map[string]string),
+}
+
+// normalizeEmail is the form emails are compared and indexed in, so that
+// addresses differing only in case or surrounding space are one account.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (us *UserStore) Create(user *User) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	key := normalizeEmail(user.Email)
+	if _, exists := us.byEmail[key]; exists {
+		return errUserExists
+	}
+	if _, exists := us.users[user.ID]; exists {
+		return errUserExists
+	}
+	u := *user
+	us.users[user.ID] = &u
+	us.byEmail[key] = user.ID
+	return nil
+}
+
+func (us *UserStore) GetByID(id string) (*User, bool) {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	user, exists := us.users[id]
+	if !exists {
+		return nil, false
+	}
+	u := *user
+	return &u, true
+}
+
+func (us *UserStore) GetByEmail(email string) (*User, bool) {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	id, exists := us.byEmail[normalizeEmail(email)]
+	if !exists {
+		return nil, false
+	}
+	u := *us.users[id]
+	return &u, true
+}
+
+// Update replaces the stored user with the same ID. An email change moves
+// the email index in the same step, and fails if another account has it.
+func (us *UserStore) Update(user *User) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	existing, exists := us.users[user.ID]
+	if !exists {
+		return errUserNotFound
+	}
+	oldKey, newKey := normalizeEmail(existing.Email), normalizeEmail(user.Email)
+	if oldKey != newKey {
+		if _, taken := us.byEmail[newKey]; taken {
+			return errUserExists
+		}
+		delete(us.byEmail, oldKey)
+		us.byEmail[newKey] = user.ID
+	}
+	u := *user
+	us.users[user.ID] = &u
+	return nil
+}
@@ -14,13 +14,53 @@ type VerificationToken struct {
 	ExpiresAt time.Time
 }
 
-var verificationTokens = &struct {
+// VerificationTokenStore is the in-memory VerificationTokenRepository.
+type VerificationTokenStore struct {
 	mu     sync.RWMutex
 	tokens map[string]*VerificationToken
-}{
+}
+
+var verificationTokens VerificationTokenRepository = &VerificationTokenStore{
 	tokens: make(map[string]*VerificationToken),
 }
 
+func (vs *VerificationTokenStore) Create(token *VerificationToken) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	t := *token
+	vs.tokens[token.Token] = &t
+	return nil
+}
+
+func (vs *VerificationTokenStore) Consume(token string) (*VerificationToken, bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	verificationToken, exists := vs.tokens[token]
+	if !exists {
+		return nil, false
+	}
+	delete(vs.tokens, token)
+	if time.Now().After(verificationToken.ExpiresAt) {
+		return nil, false
+	}
+	return verificationToken, true
+}
+
+func (vs *VerificationTokenStore) DeleteExpired(now time.Time) int {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	evicted := 0
+	for token, verificationToken := range vs.tokens {
+		if now.After(verificationToken.ExpiresAt) {
+			delete(vs.tokens, token)
+			evicted++
+		}
+	}
+	return evicted
+}
+
 func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -36,24 +76,20 @@ func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	verificationTokens.mu.Lock()
-	token, exists := verificationTokens.tokens[req.Token]
-	if !exists || time.Now().After(token.ExpiresAt) {
-		verificationTokens.mu.Unlock()
+	token, exists := verificationTokens.Consume(req.Token)
+	if !exists {
 		http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
 		return
 	}
 
-	// Mark user as verified
-	store.mu.Lock()
-	if user, exists := store.users[token.Email]; exists {
-		// In production, add verified field to user
-		_ = user
+	// Mark user as verified, unless the email changed since the token was sent
+	if user, exists := store.GetByID(token.UserID); exists && normalizeEmail(user.Email) == normalizeEmail(token.Email) {
+		user.EmailVerified = true
+		if err := store.Update(user); err != nil {
+			http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+			return
+		}
 	}
-	store.mu.Unlock()
-
-	delete(verificationTokens.tokens, req.Token)
-	verificationTokens.mu.Unlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -61,17 +97,15 @@ func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func generateVerificationToken(email, userID string) string {
+func generateVerificationToken(email, userID string) (string, error) {
 	token := generateToken()
-	verificationTokens.mu.Lock()
-	verificationTokens.tokens[token] = &VerificationToken{
+	err := verificationTokens.Create(&VerificationToken{
 		Token:     token,
 		UserID:    userID,
 		Email:     email,
 		ExpiresAt: time.Now().Add(24 * time.Hour),
-	}
-	verificationTokens.mu.Unlock()
-	return token
+	})
+	return token, err
 }
 
 
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"net/url"
+	"strings"
+)
+
+const (
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+
+	// cborMaxDepth bounds nesting; COSE keys and attestation objects need
+	// three levels at most
+	cborMaxDepth = 16
+)
+
+var (
+	errInvalidCBOR       = errors.New("invalid cbor")
+	errInvalidClientData = errors.New("invalid client data")
+	errInvalidAuthData   = errors.New("invalid authenticator data")
+	errUnsupportedKey    = errors.New("unsupported credential key")
+	errInvalidSignature  = errors.New("invalid signature")
+)
+
+// RelyingParty identifies this server to authenticators. Origin must match
+// the page the browser runs the ceremony on.
+type RelyingParty struct {
+	ID     string
+	Name   string
+	Origin string
+}
+
+var relyingParty *RelyingParty
+
+func newRelyingPartyFromEnv() *RelyingParty {
+	origin := strings.TrimSuffix(getEnv("WEBAUTHN_ORIGIN", jwtIssuer.issuer), "/")
+	rpID := getEnv("WEBAUTHN_RP_ID", "")
+	if rpID == "" {
+		if u, err := url.Parse(origin); err == nil {
+			rpID = u.Hostname()
+		}
+	}
+	return &RelyingParty{
+		ID:     rpID,
+		Name:   getEnv("WEBAUTHN_RP_NAME", "go-auth-api"),
+		Origin: origin,
+	}
+}
+
+type collectedClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// parseClientData decodes clientDataJSON without checking it, so the
+// challenge can be used to find the ceremony it belongs to.
+func parseClientData(raw []byte) (*collectedClientData, error) {
+	var cd collectedClientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, errInvalidClientData
+	}
+	return &cd, nil
+}
+
+func (rp *RelyingParty) verifyClientData(cd *collectedClientData, ceremonyType, challenge string) error {
+	if cd.Type != ceremonyType || cd.Challenge != challenge || cd.Origin != rp.Origin {
+		return errInvalidClientData
+	}
+	return nil
+}
+
+// authenticatorData is the binary structure signed by the authenticator
+// (WebAuthn section 6.1). The attested credential fields are only present
+// during registration.
+type authenticatorData struct {
+	Raw          []byte
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, errInvalidAuthData
+	}
+	ad := &authenticatorData{
+		Raw:       raw,
+		RPIDHash:  raw[:32],
+		Flags:     raw[32],
+		SignCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	if ad.Flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, errInvalidAuthData
+	}
+	ad.AAGUID = rest[:16]
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return nil, errInvalidAuthData
+	}
+	ad.CredentialID = rest[:idLen]
+	rest = rest[idLen:]
+
+	// The COSE key is followed by optional extensions, so its length is only
+	// known once it has been decoded
+	_, after, err := cborDecode(rest)
+	if err != nil {
+		return nil, errInvalidAuthData
+	}
+	ad.PublicKey = rest[:len(rest)-len(after)]
+	return ad, nil
+}
+
+func (rp *RelyingParty) verifyAuthenticatorData(ad *authenticatorData, requireUV bool) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) {
+		return errInvalidAuthData
+	}
+	if ad.Flags&flagUserPresent == 0 {
+		return errInvalidAuthData
+	}
+	if requireUV && ad.Flags&flagUserVerified == 0 {
+		return errInvalidAuthData
+	}
+	return nil
+}
+
+// parseAttestationObject returns the authenticator data from a registration
+// response. Attestation statements are not verified: registration asks for
+// "none" conveyance, so there is no authenticator vendor to trust.
+func parseAttestationObject(raw []byte) (*authenticatorData, error) {
+	v, _, err := cborDecode(raw)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errInvalidCBOR
+	}
+	authData, ok := obj["authData"].([]byte)
+	if !ok {
+		return nil, errInvalidAuthData
+	}
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.CredentialID == nil {
+		return nil, errInvalidAuthData
+	}
+	return ad, nil
+}
+
+// parseCOSEKey converts a COSE_Key (RFC 8152 section 7) into a public key.
+// Only ES256 and RS256 are supported, matching what registration offers.
+func parseCOSEKey(raw []byte) (crypto.PublicKey, int64, error) {
+	v, _, err := cborDecode(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errUnsupportedKey
+	}
+	alg, _ := key[int64(3)].(int64)
+
+	switch alg {
+	case coseAlgES256:
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if key[int64(1)] != int64(2) || key[int64(-1)] != int64(1) || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errUnsupportedKey
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, errUnsupportedKey
+		}
+		return pub, alg, nil
+	case coseAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if key[int64(1)] != int64(3) || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errUnsupportedKey
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, alg, nil
+	}
+	return nil, 0, errUnsupportedKey
+}
+
+// verifyAssertionSignature checks the signature over authenticatorData
+// followed by the hash of clientDataJSON (WebAuthn section 7.2).
+func verifyAssertionSignature(pub crypto.PublicKey, alg int64, authData, clientDataJSON, sig []byte) error {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		if alg == coseAlgES256 && ecdsa.VerifyASN1(key, digest[:], sig) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if alg == coseAlgRS256 && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+			return nil
+		}
+	}
+	return errInvalidSignature
+}
+
+// decodeBase64URL accepts base64url with or without padding, since browser
+// helpers differ.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// cborDecode decodes the subset of CBOR (RFC 8949) that authenticators
+// produce: integers, byte and text strings, arrays, maps and simple values.
+// It returns the value and the bytes following it.
+func cborDecode(data []byte) (interface{}, []byte, error) {
+	return cborDecodeItem(data, 0)
+}
+
+func cborDecodeItem(data []byte, depth int) (interface{}, []byte, error) {
+	if len(data) == 0 || depth > cborMaxDepth {
+		return nil, nil, errInvalidCBOR
+	}
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, errInvalidCBOR
+		}
+		for _, b := range data[:size] {
+			n = n<<8 | uint64(b)
+		}
+		data = data[size:]
+	default:
+		// Indefinite lengths are not allowed in authenticator output
+		return nil, nil, errInvalidCBOR
+	}
+
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return nil, nil, errInvalidCBOR
+		}
+		return int64(n), data, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, errInvalidCBOR
+		}
+		return -1 - int64(n), data, nil
+	case 2, 3:
+		if n > uint64(len(data)) {
+			return nil, nil, errInvalidCBOR
+		}
+		if major == 3 {
+			return string(data[:n]), data[n:], nil
+		}
+		return data[:n], data[n:], nil
+	case 4:
+		// Every element takes at least a byte, which bounds the loop
+		if n > uint64(len(data)) {
+			return nil, nil, errInvalidCBOR
+		}
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			item, rest, err := cborDecodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+			data = rest
+		}
+		return items, data, nil
+	case 5:
+		if n > uint64(len(data)) {
+			return nil, nil, errInvalidCBOR
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			key, rest, err := cborDecodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errInvalidCBOR
+			}
+			value, rest, err := cborDecodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+			data = rest
+		}
+		return m, data, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22:
+			return nil, data, nil
+		}
+	}
+	return nil, nil, errInvalidCBOR
+}
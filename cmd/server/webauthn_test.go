@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net/http/httptest"
+	"testing"
+)
+
+// Minimal CBOR encoding helpers for building authenticator output.
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	case n < 1<<16:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n < 1<<32:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+}
+
+func cborInt(v int64) []byte {
+	if v < 0 {
+		return cborHead(1, uint64(-1-v))
+	}
+	return cborHead(0, uint64(v))
+}
+
+func cborBytes(b []byte) []byte { return append(cborHead(2, uint64(len(b))), b...) }
+
+func cborText(s string) []byte { return append(cborHead(3, uint64(len(s))), s...) }
+
+// cborMap encodes alternating keys and values.
+func cborMap(items ...[]byte) []byte {
+	out := cborHead(5, uint64(len(items)/2))
+	for _, item := range items {
+		out = append(out, item...)
+	}
+	return out
+}
+
+var testRP = &RelyingParty{ID: "example.com", Name: "test", Origin: "https://example.com"}
+
+func coseES256Key(pub *ecdsa.PublicKey) []byte {
+	return cborMap(
+		cborInt(1), cborInt(2),
+		cborInt(3), cborInt(coseAlgES256),
+		cborInt(-1), cborInt(1),
+		cborInt(-2), cborBytes(pub.X.FillBytes(make([]byte, 32))),
+		cborInt(-3), cborBytes(pub.Y.FillBytes(make([]byte, 32))),
+	)
+}
+
+func testAuthData(rpID string, flags byte, signCount uint32, credentialID, coseKey []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	out := append(rpIDHash[:], flags)
+	out = binary.BigEndian.AppendUint32(out, signCount)
+	if coseKey == nil {
+		return out
+	}
+	out = append(out, make([]byte, 16)...) // AAGUID
+	out = binary.BigEndian.AppendUint16(out, uint16(len(credentialID)))
+	out = append(out, credentialID...)
+	return append(out, coseKey...)
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestParseAttestationObject(t *testing.T) {
+	key := newTestKey(t)
+	credentialID := []byte("credential-1")
+	authData := testAuthData(testRP.ID, flagUserPresent|flagAttestedData, 0, credentialID, coseES256Key(&key.PublicKey))
+
+	// Packed self attestation; the statement itself isn't verified
+	digest := sha256.Sum256(authData)
+	packedSig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		fmt  string
+		stmt []byte
+	}{
+		{"none", "none", cborMap()},
+		{"packed", "packed", cborMap(cborText("alg"), cborInt(coseAlgES256), cborText("sig"), cborBytes(packedSig))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			obj := cborMap(
+				cborText("fmt"), cborText(tc.fmt),
+				cborText("attStmt"), tc.stmt,
+				cborText("authData"), cborBytes(authData),
+			)
+			ad, err := parseAttestationObject(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(ad.CredentialID, credentialID) {
+				t.Errorf("got credential ID %q, want %q", ad.CredentialID, credentialID)
+			}
+			if err := testRP.verifyAuthenticatorData(ad, false); err != nil {
+				t.Errorf("verifyAuthenticatorData: %v", err)
+			}
+			pub, alg, err := parseCOSEKey(ad.PublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if alg != coseAlgES256 || !key.PublicKey.Equal(pub) {
+				t.Errorf("got key %v (alg %d), want the attested ES256 key", pub, alg)
+			}
+		})
+	}
+}
+
+func TestParseAttestationObjectRejectsMalformedInput(t *testing.T) {
+	key := newTestKey(t)
+	authData := testAuthData(testRP.ID, flagUserPresent|flagAttestedData, 0, []byte("id"), coseES256Key(&key.PublicKey))
+	valid := cborMap(
+		cborText("fmt"), cborText("none"),
+		cborText("attStmt"), cborMap(),
+		cborText("authData"), cborBytes(authData),
+	)
+
+	nested := cborInt(1)
+	for i := 0; i < cborMaxDepth; i++ {
+		nested = append(cborHead(4, 1), nested...)
+	}
+	if _, _, err := cborDecode(nested); err != nil {
+		t.Fatalf("nesting at the depth limit: %v", err)
+	}
+	nested = append(cborHead(4, 1), nested...)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a map", cborBytes(authData)},
+		{"missing authData", cborMap(cborText("fmt"), cborText("none"))},
+		{"byte string longer than input", append(cborHead(2, 1<<32), 0)},
+		{"array longer than input", cborHead(4, 1<<20)},
+		{"map longer than input", append(cborHead(5, 1<<20), cborInt(1)...)},
+		{"indefinite length", []byte{0x5f, 0x41, 0x00, 0xff}},
+		{"too deeply nested", nested},
+		{"authData without credential", cborMap(cborText("authData"), cborBytes(testAuthData(testRP.ID, flagUserPresent|flagAttestedData, 0, nil, nil)))},
+	}
+	for _, n := range []int{1, len(valid) / 2, len(valid) - 1} {
+		tests = append(tests, struct {
+			name string
+			data []byte
+		}{"truncated", valid[:n]})
+	}
+
+	for _, tc := range tests {
+		if _, err := parseAttestationObject(tc.data); err == nil {
+			t.Errorf("%s: parsed without error", tc.name)
+		}
+	}
+}
+
+func TestVerifyAuthenticatorData(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		rpID      string
+		flags     byte
+		requireUV bool
+		ok        bool
+	}{
+		{"valid", testRP.ID, flagUserPresent, false, true},
+		{"valid with UV", testRP.ID, flagUserPresent | flagUserVerified, true, true},
+		{"wrong rpIdHash", "evil.example", flagUserPresent, false, false},
+		{"user not present", testRP.ID, 0, false, false},
+		{"user not verified", testRP.ID, flagUserPresent, true, false},
+	} {
+		ad, err := parseAuthenticatorData(testAuthData(tc.rpID, tc.flags, 1, nil, nil))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if err := testRP.verifyAuthenticatorData(ad, tc.requireUV); (err == nil) != tc.ok {
+			t.Errorf("%s: got %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+
+	if _, err := parseAuthenticatorData(make([]byte, 36)); err == nil {
+		t.Error("parsed authenticator data shorter than 37 bytes")
+	}
+}
+
+func TestVerifyAssertionSignature(t *testing.T) {
+	key := newTestKey(t)
+	authData := testAuthData(testRP.ID, flagUserPresent, 1, nil, nil)
+	clientData := []byte(`{"type":"webauthn.get","challenge":"abc","origin":"https://example.com"}`)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, authData...)
+	tampered[len(tampered)-1]++
+
+	for _, tc := range []struct {
+		name     string
+		pub      *ecdsa.PublicKey
+		alg      int64
+		authData []byte
+		ok       bool
+	}{
+		{"valid", &key.PublicKey, coseAlgES256, authData, true},
+		{"tampered authenticator data", &key.PublicKey, coseAlgES256, tampered, false},
+		{"other key", &newTestKey(t).PublicKey, coseAlgES256, authData, false},
+		{"algorithm mismatch", &key.PublicKey, coseAlgRS256, authData, false},
+	} {
+		err := verifyAssertionSignature(tc.pub, tc.alg, tc.authData, clientData, sig)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestPasskeySignCount(t *testing.T) {
+	for _, tc := range []struct {
+		stored, signCount uint32
+		ok                bool
+	}{
+		{0, 0, true},
+		{0, 1, true},
+		{5, 6, true},
+		{5, 5, false},
+		{5, 4, false},
+		{5, 0, false},
+	} {
+		ps := &PasskeyStore{credentials: make(map[string]*WebAuthnCredential)}
+		if err := ps.Add(&WebAuthnCredential{ID: "cred", UserID: "user", SignCount: tc.stored}); err != nil {
+			t.Fatal(err)
+		}
+		err := ps.RecordUse("cred", tc.signCount)
+		if tc.ok && err != nil {
+			t.Errorf("stored %d, asserted %d: %v", tc.stored, tc.signCount, err)
+		}
+		if !tc.ok && err != errPasskeyCloned {
+			t.Errorf("stored %d, asserted %d: got %v, want errPasskeyCloned", tc.stored, tc.signCount, err)
+		}
+	}
+}
+
+func TestPasskeyOnlyAccountRequiresMFA(t *testing.T) {
+	userID := "passkey-only-user"
+	r := httptest.NewRequest("POST", "/api/auth/login", nil)
+	if requiresMFA(r, userID, "") {
+		t.Fatal("MFA required without a second factor")
+	}
+
+	if err := passkeyStore.Add(&WebAuthnCredential{ID: "passkey-only-cred", UserID: userID}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { passkeyStore.Delete(userID, "passkey-only-cred") })
+
+	if !requiresMFA(r, userID, "") {
+		t.Error("MFA not required for an account with a passkey")
+	}
+	// The HTML sign-in pages can't use the passkey, so they must refuse
+	if amr, message := formSecondFactor(r, userID, ""); message == "" {
+		t.Errorf("sign-in page accepted a password alone, amr %v", amr)
+	}
+}